@@ -11,6 +11,7 @@ type MemoryStore struct {
 }
 
 var _ Store = &MemoryStore{}
+var _ Adder = &MemoryStore{}
 
 func NewMemoryStore(defaultExpiration, cleanupInterval time.Duration) *MemoryStore {
 	c := memory.New(defaultExpiration, cleanupInterval)
@@ -38,6 +39,13 @@ func (c *MemoryStore) Set(key string, value interface{}, expire time.Duration) e
 	return nil
 }
 
+func (c *MemoryStore) Add(key string, value interface{}, expire time.Duration) error {
+	if err := c.Cache.Add(key, value, expire); err != nil {
+		return ErrNotStored
+	}
+	return nil
+}
+
 func (c *MemoryStore) Delete(key string) error {
 	c.Cache.Delete(key)
 	return nil
@@ -84,6 +84,33 @@ func (c *RedisStore) Set(key string, value interface{}, expire time.Duration) er
 	}
 }
 
+func (c *RedisStore) Add(key string, value interface{}, expire time.Duration) error {
+	b, err := serialize(value)
+	if err != nil {
+		return err
+	}
+
+	conn := c.pool.Get()
+	defer conn.Close()
+
+	var reply interface{}
+	if expire != FOREVER {
+		if expire == DEFAULT {
+			expire = c.defaultExpiration
+		}
+		reply, err = conn.Do("SET", key, b, "EX", int32(expire/time.Second), "NX")
+	} else {
+		reply, err = conn.Do("SET", key, b, "NX")
+	}
+	if err != nil {
+		return err
+	}
+	if reply == nil {
+		return ErrNotStored
+	}
+	return nil
+}
+
 func (c *RedisStore) Delete(key string) error {
 	conn := c.pool.Get()
 	defer conn.Close()
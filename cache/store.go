@@ -11,6 +11,7 @@ const (
 )
 
 var ErrCacheMiss = errors.New("cache missing")
+var ErrNotStored = errors.New("cache not stored")
 
 type Store interface {
     // Get retrieves item from cache, and return nil.
@@ -29,3 +30,10 @@ type Store interface {
     // Clear all items from
     Clear() error
 }
+
+// Adder is implemented by stores which can set an item atomically only if the key does not exist.
+type Adder interface {
+    // Add sets item to cache only if the key does not exist.
+    // If the key exists, return ErrNotStored.
+    Add(key string, value interface{}, expire time.Duration) error
+}
@@ -1,12 +1,15 @@
 package melware
 
 import (
+	"crypto"
 	"github.com/ridewindx/mel"
 	"github.com/dgrijalva/jwt-go"
+	"github.com/ridewindx/melware/cache"
 	"net/http"
-	"strings"
 	"time"
 	"errors"
+	"fmt"
+	"sync"
 )
 
 // JWT provides a Json-Web-Token authentication implementation.
@@ -15,31 +18,119 @@ import (
 // c.Get("userID").(string).
 // Users can get a token by posting a json request to LoginHandler. The token then needs to be passed in
 // the Authentication header.
+// With an asymmetric SigningAlgorithm, services that only hold the PublicKey can run
+// Middleware in verify-only mode, while tokens are issued elsewhere with the PrivateKey.
 type JWT struct {
 	// Realm specifies the realm name to display to the user.
 	// Optional.
 	Realm string
 
 	// SigningAlgorithm specifies signing algorithm.
+	// Possible values are HS256, HS384, HS512, RS256, RS384, RS512,
+	// PS256, PS384, PS512, ES256, ES384, ES512 and EdDSA.
 	// Optional. Default is HS256.
 	SigningAlgorithm string
 
-	// Key specifies the secret key used for signing.
-	// Required.
+	// Key specifies the secret key used for signing and verification with HMAC algorithms.
+	// Required for HMAC algorithms.
 	Key []byte
 
+	// PrivateKey specifies the key used for signing with asymmetric algorithms,
+	// i.e., *rsa.PrivateKey, *ecdsa.PrivateKey or ed25519.PrivateKey.
+	// Required for LoginHandler and RefreshHandler with asymmetric algorithms.
+	PrivateKey crypto.PrivateKey
+
+	// PublicKey specifies the key used for verification with asymmetric algorithms,
+	// i.e., *rsa.PublicKey, *ecdsa.PublicKey or ed25519.PublicKey.
+	// Optional. Defaults to the public half of PrivateKey.
+	PublicKey crypto.PublicKey
+
+	// PrivateKeyFile specifies a PEM file to load PrivateKey from.
+	// Optional. Use ParsePrivateKeyPEM to load it from bytes instead.
+	PrivateKeyFile string
+
+	// PublicKeyFile specifies a PEM file to load PublicKey from.
+	// Optional. Use ParsePublicKeyPEM to load it from bytes instead.
+	PublicKeyFile string
+
+	// Keys specifies a set of keys identified by their IDs for key rotation.
+	// New tokens are signed with the active key and carry its ID in the "kid" header,
+	// and tokens are verified with the key their "kid" header refers to,
+	// as long as the key has not expired.
+	// Optional. If set, Key, PrivateKey, PublicKey, PrivateKeyFile and PublicKeyFile are ignored.
+	Keys []*JWTKey
+
+	// ActiveKeyID specifies the ID of the key in Keys used for signing.
+	// Optional. Defaults to the ID of the first key.
+	ActiveKeyID string
+
+	// RemoteKeys specifies the key set of an external identity provider
+	// used to verify tokens issued by it, e.g., NewDiscoveryKeySet(url).
+	// Optional. If set, all the local keys are ignored,
+	// and LoginHandler and RefreshHandler are unavailable.
+	RemoteKeys *RemoteKeySet
+
+	// EncryptionKey specifies the key for encrypting issued tokens into nested
+	// signed-then-encrypted JWE tokens with A256GCM, so that the claims are not readable by clients.
+	// It is a 32 bytes []byte for direct encryption ("dir"),
+	// or an *rsa.PublicKey for RSA-OAEP key management.
+	// Optional. By default tokens are only signed.
+	EncryptionKey interface{}
+
+	// DecryptionKey specifies the key for decrypting encrypted tokens,
+	// which is the same []byte for direct encryption, or the *rsa.PrivateKey for RSA-OAEP.
+	// Signed tokens without encryption are still accepted.
+	// Optional. Defaults to EncryptionKey for direct encryption.
+	DecryptionKey interface{}
+
+	// EncryptionAlgorithm specifies the key management algorithm of encrypted tokens,
+	// "dir", "RSA-OAEP" or "RSA-OAEP-256".
+	// Optional. Defaults to "dir" for []byte keys and "RSA-OAEP" for RSA keys.
+	EncryptionAlgorithm string
+
 	// Timeout specifies the duration that a token is valid.
 	// Optional. Defaults to one hour.
 	Timeout time.Duration
 
-	// MaxRefresh specifies the maximum duration in which the client can refresh its token.
+	// Issuer specifies the "iss" claim of issued tokens.
+	// If set, tokens with a different issuer are rejected.
+	// Optional.
+	Issuer string
+
+	// Audience specifies the "aud" claim of issued tokens.
+	// If set, tokens not intended for any of the audience are rejected.
+	// Optional.
+	Audience []string
+
+	// Leeway specifies the tolerance of clock skew between hosts
+	// when validating the "exp", "nbf" and "iat" claims.
+	// Optional. Defaults to 0.
+	Leeway time.Duration
+
+	// MaxRefresh specifies the maximum duration after login in which the client can refresh its token
+	// by RefreshHandler.
 	// Optional. Defaults to 0 meaning not refreshable.
 	MaxRefresh time.Duration
 
+	// RefreshStore specifies the store of opaque refresh tokens.
+	// If set, LoginHandler also returns a refresh token, which can be exchanged for
+	// a new token pair by RefreshTokenHandler. In cookie mode, the refresh token is set
+	// in a cookie only sent to RefreshCookiePath instead. Refresh tokens are rotated on every use,
+	// and reusing a rotated refresh token revokes all refresh tokens descending from the same login.
+	// Concurrent uses of a refresh token are detected as reuse across processes only if
+	// the store implements cache.Adder, as cache.MemoryStore and cache.RedisStore do;
+	// otherwise they are only detected within the process.
+	// Optional.
+	RefreshStore cache.Store
+
+	// RefreshTimeout specifies the duration that a refresh token is valid.
+	// Optional. Defaults to 7 days.
+	RefreshTimeout time.Duration
+
 	// Authenticate specifies the callback that should perform the authentication
 	// of the user based on request context.
 	// Must return nil error on success, error on failure.
-	// Required. Optional return user id, if so, user id will be stored in Claim Array.
+	// Required for LoginHandler. Optional return user id, if so, user id will be stored in Claim Array.
 	Authenticate func(c *mel.Context) (string, error)
 
 	// Authorize specifies the callback that should perform the authorization
@@ -51,27 +142,170 @@ type JWT struct {
 	// PayloadFunc specifies the callback that will be called during login.
 	// It is useful for adding additional payload data to the token.
 	// The data is then made available during requests via ExtractClaims(PayloadKey).
-	// Note that the payload is not encrypted.
+	// Note that the payload is not encrypted unless EncryptionKey is set.
 	// Optional. By default no additional payload will be added.
 	PayloadFunc func(userID string) map[string]interface{}
 
-	// Unauthorized specifies the unauthorized function.
-	Unauthorized func(*mel.Context, int, string)
+	// NewClaims specifies the factory of the claims type that tokens are parsed into,
+	// which usually returns a pointer to a struct embedding jwt.StandardClaims, e.g.,
+	//   func() jwt.Claims { return &MyClaims{} }
+	// The typed claims are made available during requests via ExtractTypedClaims,
+	// and tokens whose claims can't be decoded into the type are rejected.
+	// An array "aud" claim is reduced to the audience accepted by Audience
+	// if the type only accepts a string, like jwt.StandardClaims.
+	// Optional.
+	NewClaims func() jwt.Claims
+
+	// ClaimsFunc specifies the callback that will be called during login
+	// to build typed claims for the user, which are added to the token like PayloadFunc.
+	// The identity, "exp", "iat", "nbf", "orig_iat" and "jti" claims are always set by JWT,
+	// as well as "iss" and "aud" if Issuer and Audience are set.
+	// Optional.
+	ClaimsFunc func(userID string) jwt.Claims
+
+	// Unauthorized specifies the unauthorized function,
+	// which is called with the HTTP status code and the error.
+	// Rejected tokens are reported as *TokenError carrying the RFC 6750 error code,
+	// and the reason can be found out by errors.Is, e.g., errors.Is(err, ErrTokenExpired).
+	// Optional. Default to respond {"code": CODE, "message": MESSAGE, "error": RFC6750_ERROR_CODE}.
+	Unauthorized func(*mel.Context, int, error)
 
-	// TokenBearer is a string in the form of "<source>:<name>"
+	// TokenBearer is a comma-separated list of strings in the form of "<source>:<name>"
 	// that is used to extract token from the request.
+	// The sources are tried in order, and the first token found is used.
 	// Optional. Default to "header:Authorization".
 	// Possible values:
-	// - "header:<name>"
+	// - "header:<name>", the header value must be of the form "Bearer <token>"
+	// - "header:<name>:<scheme>", the header value must be of the form "<scheme> <token>"
+	// - "header:<name>:", the header value is the token itself
 	// - "query:<name>"
 	// - "cookie:<name>"
+	// E.g., "header:Authorization, cookie:jwt".
 	TokenBearer string
 
+	// SendCookie specifies whether to deliver tokens to browser clients in cookies,
+	// so that they are not readable by JavaScript.
+	// LoginHandler and RefreshHandler set the token in a Secure, HttpOnly and SameSite cookie,
+	// along with a CSRF token in a cookie readable by JavaScript.
+	// Middleware accepts the token cookie, but for unsafe methods requires
+	// the CSRF token to be sent back in the CSRFHeader header.
+	// Optional. Default to false.
+	SendCookie bool
+
+	// CookieName specifies the name of the token cookie.
+	// Optional. Default to "jwt".
+	CookieName string
+
+	// CookieDomain specifies the domain of the token and CSRF cookies.
+	// Optional.
+	CookieDomain string
+
+	// CookieInsecure specifies whether to omit the Secure attribute of cookies,
+	// which is only useful for development over plain HTTP.
+	// Optional. Default to false.
+	CookieInsecure bool
+
+	// CookieSameSite specifies the SameSite attribute of cookies.
+	// Optional. Default to http.SameSiteLaxMode.
+	CookieSameSite http.SameSite
+
+	// CSRFCookieName specifies the name of the CSRF token cookie.
+	// Optional. Default to "csrf_token".
+	CSRFCookieName string
+
+	// RefreshCookieName specifies the name of the refresh token cookie in cookie mode.
+	// Optional. Default to "refresh_token".
+	RefreshCookieName string
+
+	// RefreshCookiePath specifies the path of the refresh token cookie in cookie mode,
+	// which should be the path of RefreshTokenHandler, so that the cookie is not sent elsewhere.
+	// Required if SendCookie and RefreshStore are set.
+	RefreshCookiePath string
+
+	// CSRFHeader specifies the header in which clients send back the CSRF token.
+	// Optional. Default to "X-CSRF-Token".
+	CSRFHeader string
+
+	// RevocationStore specifies the store of revoked token IDs.
+	// Use a shared store, e.g., cache.RedisStore, to share revocations across instances.
+	// Tokens issued by LoginHandler carry a unique ID in the "jti" claim,
+	// which can be revoked by Revoke or RevokeToken.
+	// Optional. If nil, tokens can not be revoked.
+	RevocationStore cache.Store
+
+	// TokenVersion specifies the callback that returns the current token version of the user,
+	// which is usually a counter stored along with the user and increased on password change.
+	// LoginHandler embeds the version in the "ver" claim, and Middleware rejects tokens
+	// whose version is stale, so that all tokens of a user can be invalidated at once.
+	// Optional.
+	TokenVersion func(userID string) (int, error)
+
+	// TokenVersionStore specifies the store for caching token versions,
+	// to avoid calling TokenVersion on every request.
+	// Optional. If nil, versions are not cached.
+	TokenVersionStore cache.Store
+
+	// TokenVersionTimeout specifies the duration that token versions are cached.
+	// Optional. Defaults to one minute.
+	TokenVersionTimeout time.Duration
+
+	// DPoP enables binding tokens to client keys by RFC 9449 DPoP proofs.
+	// If the login request carries a "DPoP" proof header, the issued token is bound to the key
+	// of the proof by the "cnf" claim. Bound tokens must be presented with the "DPoP" authentication
+	// scheme and a valid proof of the same key, so that leaked tokens can't be replayed.
+	// Unbound tokens are still accepted as bearer tokens.
+	// Optional. Default to false.
+	DPoP bool
+
+	// DPoPStore specifies the store of used DPoP proof IDs for detecting replayed proofs.
+	// Concurrent uses of a proof are detected as replays across processes only if
+	// the store implements cache.Adder, as cache.MemoryStore and cache.RedisStore do;
+	// otherwise they are only detected within the process.
+	// Required if DPoP is set.
+	DPoPStore cache.Store
+
+	// DPoPLifetime specifies the duration that a DPoP proof is accepted after its "iat" claim.
+	// Optional. Defaults to one minute.
+	DPoPLifetime time.Duration
+
+	// IntrospectionClients specifies the client IDs and secrets
+	// which are allowed to call IntrospectionHandler.
+	// Required for IntrospectionHandler.
+	IntrospectionClients map[string]string
+
+	// IdentityKey specifies the claim which holds the user ID.
+	// Optional. Default to "id". Set it to "sub" for tokens issued by identity providers.
+	IdentityKey string
+
+	// ScopeClaim specifies the claim which holds the granted scopes for RequireScopes.
+	// Optional. Default to "scope".
+	ScopeClaim string
+
+	// RolesClaim specifies the claim which holds the granted roles for RequireRoles.
+	// Optional. Default to "roles".
+	RolesClaim string
+
 	// PayloadKey specifies the key when puts JWT payload into Context.
 	// Optional. Default to "JWT_PAYLOAD".
 	PayloadKey string
 
-	extractToken func(*mel.Context) (string, error)
+	// ClaimsKey specifies the key when puts typed claims into Context.
+	// Optional. Default to "JWT_CLAIMS".
+	ClaimsKey string
+
+	tokenSources []tokenSource
+
+	keys      []*JWTKey
+	activeKey *JWTKey
+
+	initialized bool
+	refreshOnce sync.Once
+
+	// refreshMu serializes the rotation of refresh tokens if RefreshStore is not a cache.Adder.
+	refreshMu sync.Mutex
+
+	// dpopMu serializes the replay check of DPoP proofs if DPoPStore is not a cache.Adder.
+	dpopMu sync.Mutex
 }
 
 func (j *JWT) init() {
@@ -79,16 +313,23 @@ func (j *JWT) init() {
 		j.SigningAlgorithm = "HS256"
 	}
 
-	if j.Key == nil {
-		panic("Secret key is required")
+	if j.RemoteKeys == nil {
+		j.initKeys()
 	}
 
+	j.initEncryption()
+	j.initDPoP()
+
 	if j.Timeout == 0 {
 		j.Timeout = time.Hour
 	}
 
-	if j.Authenticate == nil {
-		panic("Authenticate funciton is required")
+	if j.TokenVersionTimeout == 0 {
+		j.TokenVersionTimeout = time.Minute
+	}
+
+	if j.RefreshTimeout == 0 {
+		j.RefreshTimeout = 7 * 24 * time.Hour
 	}
 
 	if j.Authorize == nil {
@@ -98,66 +339,153 @@ func (j *JWT) init() {
 	}
 
 	if j.Unauthorized == nil {
-		j.Unauthorized = func(c *mel.Context, code int, message string) {
-			c.JSON(code, mel.Map{
+		j.Unauthorized = func(c *mel.Context, code int, err error) {
+			resp := mel.Map{
 				"code":    code,
-				"message": message,
-			})
+				"message": err.Error(),
+			}
+
+			var te *TokenError
+			if errors.As(err, &te) && te.Code != "" {
+				resp["error"] = te.Code
+			}
+
+			c.JSON(code, resp)
 		}
 	}
 
+	if j.CookieName == "" {
+		j.CookieName = "jwt"
+	}
+
+	if j.CookieSameSite == 0 {
+		j.CookieSameSite = http.SameSiteLaxMode
+	}
+
+	if j.CSRFCookieName == "" {
+		j.CSRFCookieName = "csrf_token"
+	}
+
+	if j.CSRFHeader == "" {
+		j.CSRFHeader = "X-CSRF-Token"
+	}
+
+	if j.RefreshCookieName == "" {
+		j.RefreshCookieName = "refresh_token"
+	}
+
+	if j.SendCookie && j.RefreshStore != nil && j.RefreshCookiePath == "" {
+		panic("Refresh cookie path is required in cookie mode")
+	}
+
 	if j.TokenBearer == "" {
 		j.TokenBearer = "header:Authorization"
+		if j.DPoP {
+			j.TokenBearer += ", header:Authorization:DPoP"
+		}
+		if j.SendCookie {
+			j.TokenBearer += ", cookie:" + j.CookieName
+		}
 	}
 
-	parts := strings.Split(j.TokenBearer, ":")
-	key := parts[1]
-	switch parts[0] {
-	case "header":
-		j.extractToken = func(c *mel.Context) (string, error) {
-			authHeader := c.Request.Header.Get(key)
+	j.tokenSources = parseTokenSources(j.TokenBearer)
 
-			if len(authHeader) == 0 {
-				return "", errors.New("empty auth header")
-			}
+	if len(j.IdentityKey) == 0 {
+		j.IdentityKey = "id"
+	}
 
-			parts := strings.SplitN(authHeader, " ", 2)
-			if !(len(parts) == 2 && parts[0] == "Bearer") {
-				return "", errors.New("invalid auth header")
-			}
+	if len(j.ScopeClaim) == 0 {
+		j.ScopeClaim = "scope"
+	}
 
-			return parts[1], nil
-		}
+	if len(j.RolesClaim) == 0 {
+		j.RolesClaim = "roles"
+	}
 
-	case "query":
-		j.extractToken = func(c *mel.Context) (string, error) {
-			token := c.Query(key)
+	if len(j.PayloadKey) == 0 {
+		j.PayloadKey = "JWT_PAYLOAD"
+	}
 
-			if len(token) == 0 {
-				return "", errors.New("empty query token")
-			}
+	if len(j.ClaimsKey) == 0 {
+		j.ClaimsKey = "JWT_CLAIMS"
+	}
+
+	j.initialized = true
+}
 
-			return token, nil
+// initKeys builds the key set from Keys, or from the single key fields if Keys is empty.
+func (j *JWT) initKeys() {
+	if len(j.Keys) == 0 {
+		j.keys = []*JWTKey{{
+			Algorithm:      j.SigningAlgorithm,
+			Key:            j.Key,
+			PrivateKey:     j.PrivateKey,
+			PublicKey:      j.PublicKey,
+			PrivateKeyFile: j.PrivateKeyFile,
+			PublicKeyFile:  j.PublicKeyFile,
+		}}
+	} else {
+		j.keys = j.Keys
+	}
+
+	ids := make(map[string]bool)
+	for _, key := range j.keys {
+		if ids[key.ID] {
+			panic("Duplicate key ID " + key.ID)
 		}
+		ids[key.ID] = true
 
-	case "cookie":
-		j.extractToken = func(c *mel.Context) (string, error) {
-			cookie, _ := c.Cookie(key)
+		key.init(j.SigningAlgorithm)
+	}
 
-			if len(cookie) == 0 {
-				return "", errors.New("empty cookie token")
+	j.activeKey = j.keys[0]
+	if j.ActiveKeyID != "" {
+		j.activeKey = nil
+		for _, key := range j.keys {
+			if key.ID == j.ActiveKeyID {
+				j.activeKey = key
 			}
-
-			return cookie, nil
 		}
+		if j.activeKey == nil {
+			panic("Active key " + j.ActiveKeyID + " not found")
+		}
+	}
+}
 
-	default:
-		panic("Invalid token source")
+// signToken signs the claims with the active key,
+// and encrypts the signed token if EncryptionKey is set.
+func (j *JWT) signToken(claims jwt.MapClaims) (string, error) {
+	key := j.activeKey
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(key.Algorithm), claims)
+	if key.ID != "" {
+		token.Header["kid"] = key.ID
 	}
 
-	if len(j.PayloadKey) == 0 {
-		j.PayloadKey = "JWT_PAYLOAD"
+	tokenStr, err := token.SignedString(key.signingKey())
+	if err != nil || j.EncryptionKey == nil {
+		return tokenStr, err
 	}
+	return j.encryptToken(tokenStr)
+}
+
+// verificationKey finds the key for verifying the token by its "kid" header.
+func (j *JWT) verificationKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	for _, key := range j.keys {
+		if key.ID != kid {
+			continue
+		}
+		if key.expired() {
+			return nil, errors.New("signing key expired")
+		}
+		if jwt.GetSigningMethod(key.Algorithm) != token.Method {
+			return nil, errors.New("invalid signing algorithm")
+		}
+		return key.verificationKey(), nil
+	}
+
+	return nil, errors.New("unknown signing key")
 }
 
 // Middleware returns a middleware that authorizes tokens.
@@ -165,21 +493,45 @@ func (j *JWT) Middleware() mel.Handler {
 	j.init()
 
 	return func(c *mel.Context) {
-		token, err := j.parseToken(c)
+		tokenStr, source, err := j.extractToken(c)
+		if err != nil {
+			j.rejectToken(c, err)
+			return
+		}
 
+		token, err := j.verifyToken(tokenStr)
 		if err != nil {
-			j.unauthorized(c, http.StatusUnauthorized, err.Error())
+			j.rejectToken(c, err)
 			return
 		}
 
 		claims := token.Claims.(jwt.MapClaims)
 
-		userId := claims["id"].(string)
+		if j.SendCookie && source.Kind == "cookie" && !j.checkCSRF(c, claims) {
+			j.unauthorized(c, http.StatusForbidden, ErrInvalidCSRFToken)
+			return
+		}
+
+		if err := j.checkDPoP(c, tokenStr, source, claims); err != nil {
+			j.rejectToken(c, err)
+			return
+		}
+
+		userId, typed, err := j.checkToken(token)
+		if err != nil {
+			j.rejectToken(c, err)
+			return
+		}
+
+		if typed != nil {
+			c.Set(j.ClaimsKey, typed)
+		}
+
 		c.Set(j.PayloadKey, claims)
 		c.Set("userID", userId)
 
 		if !j.Authorize(userId, c) {
-			j.unauthorized(c, http.StatusForbidden, "You don't have permission to access")
+			j.unauthorized(c, http.StatusForbidden, errors.New("You don't have permission to access"))
 			return
 		}
 
@@ -188,80 +540,271 @@ func (j *JWT) Middleware() mel.Handler {
 	}
 }
 
+// checkToken checks the verified token against the identity claim, the revocation list
+// and the type of NewClaims.
+// Returns the user ID, and the typed claims if NewClaims is set.
+func (j *JWT) checkToken(token *jwt.Token) (string, jwt.Claims, error) {
+	claims := token.Claims.(jwt.MapClaims)
+
+	userID, _ := claims[j.IdentityKey].(string)
+	if userID == "" {
+		return "", nil, &TokenError{
+			Code:        ErrorCodeInvalidToken,
+			Description: "missing " + j.IdentityKey + " claim",
+			Err:         ErrMalformedClaims,
+		}
+	}
+
+	jti, _ := claims["jti"].(string)
+	revoked, err := j.isRevoked(jti)
+	if err != nil {
+		return "", nil, fmt.Errorf("check token revocation failed: %w", ErrBackendUnavailable)
+	}
+	if revoked {
+		return "", nil, ErrTokenRevoked
+	}
+
+	if err := j.checkTokenVersion(userID, claims); err != nil {
+		return "", nil, err
+	}
+
+	var typed jwt.Claims
+	if j.NewClaims != nil {
+		typed, err = j.decodeClaims(token)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	return userID, typed, nil
+}
+
 // LoginHandler can be used by clients to get a jwt token.
-// Reply will be of the form {"token": "TOKEN"}.
+// Reply will be of the form {"token": "TOKEN"},
+// plus {"refresh_token": "REFRESH_TOKEN"} if RefreshStore is set.
+// In cookie mode, the tokens are set as cookies instead.
 func (j *JWT) LoginHandler() mel.Handler {
 	j.init()
 
+	if j.Authenticate == nil {
+		panic("Authenticate funciton is required")
+	}
+
+	if j.activeKey == nil || j.activeKey.signingKey() == nil {
+		panic("Private key is required for signing")
+	}
+
 	return func(c *mel.Context) {
 		userID, err := j.Authenticate(c)
 		if err != nil {
-			j.unauthorized(c, http.StatusUnauthorized, err.Error())
+			j.unauthorized(c, http.StatusUnauthorized, err)
 			return
 		}
 
-		// Create the token
-		token := jwt.New(jwt.GetSigningMethod(j.SigningAlgorithm))
-		claims := token.Claims.(jwt.MapClaims)
+		// Bind the token to the key of the DPoP proof, if any.
+		var jkt string
+		if j.DPoP && c.Request.Header.Get("DPoP") != "" {
+			jkt, err = j.verifyDPoPProof(c, "")
+			if err != nil {
+				j.rejectToken(c, err)
+				return
+			}
+		}
+
+		tokenStr, claims, err := j.createToken(userID, jkt)
+		if err != nil {
+			j.unauthorized(c, http.StatusUnauthorized, errors.New("Create JWT token failed"))
+			return
+		}
 
-		if j.PayloadFunc != nil {
-			for key, value := range j.PayloadFunc(userID) {
-				claims[key] = value
+		resp := j.tokenResponse(c, tokenStr, claims)
+
+		if j.RefreshStore != nil {
+			refreshToken, err := j.createRefreshToken(userID, newTokenID(), jkt)
+			if err != nil {
+				j.unauthorized(c, http.StatusUnauthorized, errors.New("Create refresh token failed"))
+				return
 			}
+			j.refreshTokenResponse(c, resp, refreshToken)
+		}
+
+		c.JSON(http.StatusOK, resp)
+	}
+}
+
+// createToken creates a signed token for the user,
+// which is bound to the client key with the JWK thumbprint jkt if it is not empty.
+func (j *JWT) createToken(userID, jkt string) (string, jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+
+	if j.ClaimsFunc != nil {
+		if err := mergeClaims(claims, j.ClaimsFunc(userID)); err != nil {
+			return "", nil, err
 		}
+	}
 
-		expire := time.Now().Add(j.Timeout)
-		claims["id"] = userID
-		claims["exp"] = expire.Unix()
-		claims["iat"] = time.Now().Unix()
+	if j.PayloadFunc != nil {
+		for key, value := range j.PayloadFunc(userID) {
+			claims[key] = value
+		}
+	}
 
-		tokenStr, err := token.SignedString(j.Key)
+	now := time.Now()
+	expire := now.Add(j.Timeout)
+	claims[j.IdentityKey] = userID
+	claims["exp"] = expire.Unix()
+	claims["iat"] = now.Unix()
+	claims["nbf"] = now.Unix()
+	claims["orig_iat"] = now.Unix()
+	claims["jti"] = newTokenID()
+
+	if j.Issuer != "" {
+		claims["iss"] = j.Issuer
+	}
 
+	if len(j.Audience) == 1 {
+		claims["aud"] = j.Audience[0]
+	} else if len(j.Audience) > 1 {
+		claims["aud"] = j.Audience
+	}
+
+	if j.SendCookie {
+		claims["csrf"] = newTokenID()
+	}
+
+	if j.TokenVersion != nil {
+		version, err := j.currentTokenVersion(userID)
 		if err != nil {
-			j.unauthorized(c, http.StatusUnauthorized, "Create JWT token failed")
-			return
+			return "", nil, err
+		}
+		claims["ver"] = version
+	}
+
+	if jkt != "" {
+		claims["cnf"] = map[string]interface{}{"jkt": jkt}
+	}
+
+	// Create the token
+	tokenStr, err := j.signToken(claims)
+	return tokenStr, claims, err
+}
+
+// tokenResponse returns the reply of a newly created token.
+// In cookie mode, the token and the CSRF token are set as cookies instead.
+func (j *JWT) tokenResponse(c *mel.Context, tokenStr string, claims jwt.MapClaims) mel.Map {
+	expire := time.Unix(claims["exp"].(int64), 0)
+
+	if j.SendCookie {
+		// Keep the cookie until the end of the refresh window,
+		// so that expired tokens can still be refreshed.
+		cookieExpire := expire
+		if origIat, ok := claims["orig_iat"].(int64); ok && j.MaxRefresh > 0 {
+			if refreshEnd := time.Unix(origIat, 0).Add(j.MaxRefresh); refreshEnd.After(cookieExpire) {
+				cookieExpire = refreshEnd
+			}
 		}
 
-		c.JSON(http.StatusOK, mel.Map{
-			"token":      tokenStr,
+		csrf, _ := claims["csrf"].(string)
+		j.setCookies(c, tokenStr, csrf, cookieExpire)
+		return mel.Map{
+			"csrf_token": csrf,
 			"expires_at": expire.Format(time.RFC3339),
-		})
+		}
+	}
+
+	return mel.Map{
+		"token":      tokenStr,
+		"expires_at": expire.Format(time.RFC3339),
 	}
 }
 
 // RefreshHandler can be used to refresh a token.
-// The token still needs to be valid on refresh.
-// Shall be put under an endpoint that is using the Middleware.
+// A token can be refreshed until MaxRefresh after the original login recorded in the
+// "orig_iat" claim, even if it has recently expired, so that active clients stay logged in
+// while idle clients have to log in again. The token still needs a valid signature and claims.
+// Shall be put under an endpoint without the Middleware, which rejects expired tokens.
 // Reply will be of the form {"token": "TOKEN"}.
 func (j *JWT) RefreshHandler(c *mel.Context) {
-	token, _ := j.parseToken(c)
+	j.refreshOnce.Do(func() {
+		if !j.initialized {
+			j.init()
+		}
+	})
+
+	if j.MaxRefresh <= 0 || j.activeKey == nil || j.activeKey.signingKey() == nil {
+		j.rejectToken(c, ErrTokenNotRefreshable)
+		return
+	}
+
+	tokenStr, source, err := j.extractToken(c)
+	if err != nil {
+		j.rejectToken(c, err)
+		return
+	}
+
+	token, err := j.parseAndVerify(tokenStr, true)
+	if err != nil {
+		j.rejectToken(c, err)
+		return
+	}
+
 	claims := token.Claims.(jwt.MapClaims)
 
-	exp := int64(claims["exp"].(float64))
+	if j.SendCookie && source.Kind == "cookie" && !j.checkCSRF(c, claims) {
+		j.unauthorized(c, http.StatusForbidden, ErrInvalidCSRFToken)
+		return
+	}
+
+	if err := j.checkDPoP(c, tokenStr, source, claims); err != nil {
+		j.rejectToken(c, err)
+		return
+	}
 
-	if exp < time.Now().Add(j.MaxRefresh).Unix() {
-		j.unauthorized(c, http.StatusUnauthorized, "Token exceeded refresh time limit")
+	if _, _, err := j.checkToken(token); err != nil {
+		j.rejectToken(c, err)
+		return
+	}
+
+	origIat, ok, err := numericDate(claims, "orig_iat")
+	if !ok && err == nil {
+		// Tokens issued before "orig_iat" was introduced kept "iat" of the login.
+		origIat, ok, err = numericDate(claims, "iat")
+	}
+	if err != nil || !ok {
+		j.rejectToken(c, &TokenError{
+			Code:        ErrorCodeInvalidToken,
+			Description: "missing orig_iat claim",
+			Err:         ErrMalformedClaims,
+		})
+		return
+	}
+
+	if !time.Now().Before(origIat.Add(j.MaxRefresh)) {
+		j.rejectToken(c, ErrRefreshExpired)
 		return
 	}
 
 	// Refresh expiration time
-	expire := time.Now().Add(j.Timeout)
+	now := time.Now()
+	expire := now.Add(j.Timeout)
+	claims["orig_iat"] = origIat.Unix()
 	claims["exp"] = expire.Unix()
+	claims["iat"] = now.Unix()
+	claims["nbf"] = now.Unix()
+	claims["jti"] = newTokenID()
 
-	// Create the token
-	alg := jwt.GetSigningMethod(j.SigningAlgorithm)
-	newToken := jwt.NewWithClaims(alg, claims)
+	if j.SendCookie {
+		claims["csrf"] = newTokenID()
+	}
 
-	tokenStr, err := newToken.SignedString(j.Key)
+	// Create the token
+	newTokenStr, err := j.signToken(claims)
 	if err != nil {
-		j.unauthorized(c, http.StatusUnauthorized, "Create JWT Token failed")
+		j.unauthorized(c, http.StatusUnauthorized, errors.New("Create JWT Token failed"))
 		return
 	}
 
-	c.JSON(http.StatusOK, mel.Map{
-		"token":      tokenStr,
-		"expires_at": expire.Format(time.RFC3339),
-	})
+	c.JSON(http.StatusOK, j.tokenResponse(c, newTokenStr, claims))
 }
 
 // ExtractClaims extracts the JWT claims.
@@ -274,27 +817,56 @@ func (j *JWT) ExtractClaims(c *mel.Context) jwt.MapClaims {
 	}
 }
 
-func (j *JWT) parseToken(c *mel.Context) (*jwt.Token, error) {
-	tokenStr, err := j.extractToken(c)
+func (j *JWT) parseToken(c *mel.Context) (*jwt.Token, *tokenSource, error) {
+	tokenStr, source, err := j.extractToken(c)
 
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	return jwt.Parse(tokenStr, func(token *jwt.Token) (interface{}, error) {
-		if jwt.GetSigningMethod(j.SigningAlgorithm) != token.Method {
-			return nil, errors.New("invalid signing algorithm")
+	token, err := j.verifyToken(tokenStr)
+	return token, source, err
+}
+
+// verifyToken parses the token and verifies its signature and claims.
+func (j *JWT) verifyToken(tokenStr string) (*jwt.Token, error) {
+	return j.parseAndVerify(tokenStr, false)
+}
+
+// parseAndVerify parses the token and verifies its signature and claims,
+// optionally accepting expired tokens.
+func (j *JWT) parseAndVerify(tokenStr string, allowExpired bool) (*jwt.Token, error) {
+	if isEncrypted(tokenStr) {
+		var err error
+		tokenStr, err = j.decryptToken(tokenStr)
+		if err != nil {
+			return nil, err
 		}
+	}
 
-		return j.Key, nil
-	})
+	keyFunc := j.verificationKey
+	if j.RemoteKeys != nil {
+		keyFunc = j.remoteVerificationKey
+	}
+
+	// Claims are validated by validateClaims to allow for Leeway.
+	parser := &jwt.Parser{SkipClaimsValidation: true}
+	token, err := parser.Parse(tokenStr, keyFunc)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := j.validateClaims(token.Claims.(jwt.MapClaims), allowExpired); err != nil {
+		return nil, err
+	}
+	return token, nil
 }
 
-func (mw *JWT) unauthorized(c *mel.Context, code int, message string) {
-	c.Header("WWW-Authenticate", "JWT realm="+mw.Realm)
+func (mw *JWT) unauthorized(c *mel.Context, code int, err error) {
+	c.Header("WWW-Authenticate", mw.challenge(err))
 	c.Abort()
 
-	mw.Unauthorized(c, code, message)
+	mw.Unauthorized(c, code, err)
 
 	return
 }
@@ -0,0 +1,113 @@
+package melware
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/ridewindx/mel"
+)
+
+// Errors of token extraction.
+var (
+	ErrTokenMissing      = errors.New("missing token")
+	ErrInvalidAuthHeader = errors.New("invalid auth header")
+)
+
+// tokenSource is a place in the request where the token is extracted from.
+type tokenSource struct {
+	// Kind is one of "header", "query" and "cookie".
+	Kind string
+
+	Name string
+
+	// Scheme is the authentication scheme preceding the token in the header value.
+	// Empty means the header value is the token itself.
+	Scheme string
+}
+
+// parseTokenSources parses the TokenBearer string.
+func parseTokenSources(bearer string) []tokenSource {
+	var sources []tokenSource
+
+	for _, s := range strings.Split(bearer, ",") {
+		parts := strings.SplitN(strings.TrimSpace(s), ":", 3)
+		if len(parts) < 2 || parts[1] == "" {
+			panic("Invalid token source " + s)
+		}
+
+		source := tokenSource{
+			Kind: parts[0],
+			Name: parts[1],
+		}
+
+		switch source.Kind {
+		case "header":
+			source.Scheme = "Bearer"
+			if len(parts) == 3 {
+				source.Scheme = parts[2]
+			}
+
+		case "query", "cookie":
+			if len(parts) == 3 {
+				panic("Invalid token source " + s)
+			}
+
+		default:
+			panic("Invalid token source " + s)
+		}
+
+		sources = append(sources, source)
+	}
+
+	return sources
+}
+
+func (s *tokenSource) extract(c *mel.Context) (string, error) {
+	var value string
+
+	switch s.Kind {
+	case "header":
+		value = c.Request.Header.Get(s.Name)
+
+	case "query":
+		value = c.Query(s.Name)
+
+	case "cookie":
+		value, _ = c.Cookie(s.Name)
+	}
+
+	if len(value) == 0 {
+		return "", ErrTokenMissing
+	}
+
+	if s.Scheme == "" {
+		return value, nil
+	}
+
+	parts := strings.SplitN(value, " ", 2)
+	if !(len(parts) == 2 && strings.EqualFold(parts[0], s.Scheme) && len(parts[1]) > 0) {
+		return "", ErrInvalidAuthHeader
+	}
+
+	return parts[1], nil
+}
+
+// extractToken extracts the token from the first token source which has it.
+func (j *JWT) extractToken(c *mel.Context) (string, *tokenSource, error) {
+	err := ErrTokenMissing
+
+	for i := range j.tokenSources {
+		source := &j.tokenSources[i]
+		token, e := source.extract(c)
+		if e == nil {
+			return token, source, nil
+		}
+
+		// Report a malformed value rather than the absence of later sources.
+		if err == ErrTokenMissing {
+			err = e
+		}
+	}
+
+	return "", nil, err
+}
@@ -0,0 +1,220 @@
+package melware
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/ridewindx/mel"
+)
+
+// Errors of claims validation.
+var (
+	ErrTokenExpired          = errors.New("token is expired")
+	ErrTokenNotValidYet      = errors.New("token is not valid yet")
+	ErrTokenUsedBeforeIssued = errors.New("token used before issued")
+	ErrInvalidIssuer         = errors.New("invalid token issuer")
+	ErrInvalidAudience       = errors.New("invalid token audience")
+	ErrMalformedClaims       = errors.New("malformed token claims")
+	ErrTokenNotRefreshable   = errors.New("token is not refreshable")
+	ErrRefreshExpired        = errors.New("token exceeded refresh time limit")
+)
+
+// validateClaims validates the time based claims allowing for Leeway,
+// and the issuer and audience claims if Issuer and Audience are set.
+// If allowExpired, the expiration time is not checked.
+func (j *JWT) validateClaims(claims jwt.MapClaims, allowExpired bool) error {
+	now := time.Now()
+
+	if exp, ok, err := numericDate(claims, "exp"); err != nil {
+		return err
+	} else if ok && !allowExpired && !now.Before(exp.Add(j.Leeway)) {
+		return ErrTokenExpired
+	}
+
+	if nbf, ok, err := numericDate(claims, "nbf"); err != nil {
+		return err
+	} else if ok && now.Add(j.Leeway).Before(nbf) {
+		return ErrTokenNotValidYet
+	}
+
+	if iat, ok, err := numericDate(claims, "iat"); err != nil {
+		return err
+	} else if ok && now.Add(j.Leeway).Before(iat) {
+		return ErrTokenUsedBeforeIssued
+	}
+
+	if j.Issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != j.Issuer {
+			return ErrInvalidIssuer
+		}
+	}
+
+	if len(j.Audience) > 0 {
+		auds, err := stringOrArray(claims, "aud")
+		if err != nil {
+			return err
+		}
+		if !containsAny(auds, j.Audience) {
+			return ErrInvalidAudience
+		}
+	}
+
+	return nil
+}
+
+// numericDate returns the time of a NumericDate claim, and whether the claim exists.
+func numericDate(claims jwt.MapClaims, name string) (time.Time, bool, error) {
+	switch v := claims[name].(type) {
+	case nil:
+		return time.Time{}, false, nil
+	case float64:
+		return time.Unix(int64(v), 0), true, nil
+	case json.Number:
+		f, err := v.Float64()
+		if err != nil {
+			return time.Time{}, false, ErrMalformedClaims
+		}
+		return time.Unix(int64(f), 0), true, nil
+	default:
+		return time.Time{}, false, ErrMalformedClaims
+	}
+}
+
+// stringOrArray returns the values of a claim which is either a string or an array of strings.
+func stringOrArray(claims jwt.MapClaims, name string) ([]string, error) {
+	switch v := claims[name].(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{v}, nil
+	case []string:
+		return v, nil
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, e := range v {
+			s, ok := e.(string)
+			if !ok {
+				return nil, ErrMalformedClaims
+			}
+			values = append(values, s)
+		}
+		return values, nil
+	default:
+		return nil, ErrMalformedClaims
+	}
+}
+
+func containsAny(values, candidates []string) bool {
+	for _, v := range values {
+		for _, c := range candidates {
+			if v == c {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Validation errors of standard claims, which are validated by validateClaims instead.
+const timeValidationErrors = jwt.ValidationErrorExpired | jwt.ValidationErrorNotValidYet | jwt.ValidationErrorIssuedAt
+
+// decodeClaims decodes the payload of the verified token into the claims type of NewClaims,
+// and validates the claims.
+func (j *JWT) decodeClaims(token *jwt.Token) (jwt.Claims, error) {
+	parts := strings.Split(token.Raw, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	payload, err := jwt.DecodeSegment(parts[1])
+	if err != nil {
+		return nil, errors.New("malformed token payload")
+	}
+
+	claims := j.NewClaims()
+	if err := json.Unmarshal(payload, claims); err != nil {
+		// Claims types embedding jwt.StandardClaims only accept a string "aud",
+		// so retry with the single audience accepted by Audience.
+		payload, ok := singleAudience(payload, j.Audience)
+		if !ok {
+			return nil, ErrMalformedClaims
+		}
+		claims = j.NewClaims()
+		if err := json.Unmarshal(payload, claims); err != nil {
+			return nil, ErrMalformedClaims
+		}
+	}
+
+	// Time based claims have been validated with Leeway,
+	// only the custom validation of the type matters.
+	if err := claims.Valid(); err != nil {
+		e, ok := err.(*jwt.ValidationError)
+		if !ok || e.Errors&^timeValidationErrors != 0 {
+			return nil, err
+		}
+	}
+	return claims, nil
+}
+
+// singleAudience replaces the array "aud" claim of the payload with its first value in accepted,
+// or its only value. The claim is dropped if there is no such value, since it has been validated.
+// It returns false if the "aud" claim is not an array.
+func singleAudience(payload []byte, accepted []string) ([]byte, bool) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		return nil, false
+	}
+
+	var auds []string
+	if err := json.Unmarshal(fields["aud"], &auds); err != nil {
+		return nil, false
+	}
+
+	aud := ""
+	if len(auds) == 1 {
+		aud = auds[0]
+	}
+	for _, a := range auds {
+		if containsAny([]string{a}, accepted) {
+			aud = a
+			break
+		}
+	}
+
+	if aud == "" {
+		delete(fields, "aud")
+	} else {
+		fields["aud"], _ = json.Marshal(aud)
+	}
+
+	b, err := json.Marshal(fields)
+	return b, err == nil
+}
+
+// mergeClaims copies the fields of typed claims into the map claims.
+func mergeClaims(claims jwt.MapClaims, typed jwt.Claims) error {
+	b, err := json.Marshal(typed)
+	if err != nil {
+		return err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber() // keep integers exact
+	return decoder.Decode(&claims)
+}
+
+// ExtractTypedClaims extracts the JWT claims parsed into the type returned by NewClaims.
+// Returns nil if NewClaims is not set.
+//
+//	claims := j.ExtractTypedClaims(c).(*MyClaims)
+func (j *JWT) ExtractTypedClaims(c *mel.Context) jwt.Claims {
+	claims, ok := c.Get(j.ClaimsKey)
+	if ok {
+		return claims.(jwt.Claims)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package melware
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/ridewindx/mel"
+)
+
+// setCookies sets the token cookie and the CSRF token cookie.
+func (j *JWT) setCookies(c *mel.Context, tokenStr, csrf string, expire time.Time) {
+	maxAge := int(time.Until(expire).Seconds())
+
+	http.SetCookie(c.Writer, j.newCookie(j.CookieName, tokenStr, maxAge, true))
+	http.SetCookie(c.Writer, j.newCookie(j.CSRFCookieName, csrf, maxAge, false))
+}
+
+// setRefreshCookie sets the refresh token cookie, which is only sent to RefreshCookiePath.
+func (j *JWT) setRefreshCookie(c *mel.Context, refreshToken string) {
+	http.SetCookie(c.Writer, j.newRefreshCookie(refreshToken, int(j.RefreshTimeout.Seconds())))
+}
+
+// clearCookies deletes the token cookie, the CSRF token cookie and the refresh token cookie.
+func (j *JWT) clearCookies(c *mel.Context) {
+	http.SetCookie(c.Writer, j.newCookie(j.CookieName, "", -1, true))
+	http.SetCookie(c.Writer, j.newCookie(j.CSRFCookieName, "", -1, false))
+	if j.RefreshStore != nil {
+		http.SetCookie(c.Writer, j.newRefreshCookie("", -1))
+	}
+}
+
+func (j *JWT) newRefreshCookie(value string, maxAge int) *http.Cookie {
+	cookie := j.newCookie(j.RefreshCookieName, value, maxAge, true)
+	cookie.Path = j.RefreshCookiePath
+	return cookie
+}
+
+func (j *JWT) newCookie(name, value string, maxAge int, httpOnly bool) *http.Cookie {
+	cookie := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		Domain:   j.CookieDomain,
+		MaxAge:   maxAge,
+		Secure:   !j.CookieInsecure,
+		HttpOnly: httpOnly,
+		SameSite: j.CookieSameSite,
+	}
+	if maxAge > 0 {
+		cookie.Expires = time.Now().Add(time.Duration(maxAge) * time.Second)
+	} else if maxAge < 0 {
+		// Set it to the past to expire now.
+		cookie.Expires = time.Unix(1, 0)
+	}
+	return cookie
+}
+
+// checkCSRF checks the double-submitted CSRF token of a request authenticated by the token cookie.
+// The CSRF header must match both the CSRF cookie and the CSRF claim of the token,
+// so that a cookie planted by an attacker is useless.
+// Safe methods are not checked.
+func (j *JWT) checkCSRF(c *mel.Context, claims jwt.MapClaims) bool {
+	switch c.Request.Method {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return true
+	}
+
+	header := c.Request.Header.Get(j.CSRFHeader)
+	cookie, _ := c.Cookie(j.CSRFCookieName)
+	claim, _ := claims["csrf"].(string)
+
+	if header == "" || claim == "" {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(header), []byte(cookie)) == 1 &&
+		subtle.ConstantTimeCompare([]byte(header), []byte(claim)) == 1
+}
+
+// LogoutHandler can be used by browser clients to log out in cookie mode.
+// It clears the token cookie, the CSRF token cookie and the refresh token cookie,
+// and revokes the token if RevocationStore is set.
+func (j *JWT) LogoutHandler() mel.Handler {
+	j.init()
+
+	return func(c *mel.Context) {
+		if token, source, err := j.parseToken(c); err == nil {
+			claims := token.Claims.(jwt.MapClaims)
+
+			if source.Kind == "cookie" && !j.checkCSRF(c, claims) {
+				j.unauthorized(c, http.StatusForbidden, ErrInvalidCSRFToken)
+				return
+			}
+
+			if j.RevocationStore != nil {
+				j.revokeClaims(claims)
+			}
+		}
+
+		j.clearCookies(c)
+
+		c.JSON(http.StatusOK, mel.Map{
+			"code":    http.StatusOK,
+			"message": "logged out",
+		})
+	}
+}
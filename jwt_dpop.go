@@ -0,0 +1,227 @@
+package melware
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/ridewindx/mel"
+	"github.com/ridewindx/melware/cache"
+	"gopkg.in/square/go-jose.v2"
+)
+
+// Errors of DPoP proofs.
+var (
+	ErrDPoPProofMissing = errors.New("missing DPoP proof")
+	ErrInvalidDPoPProof = errors.New("invalid DPoP proof")
+	ErrDPoPProofReused  = errors.New("DPoP proof reused")
+	ErrDPoPKeyMismatch  = errors.New("DPoP proof key mismatch")
+)
+
+// Key prefix for storing used DPoP proof IDs into DPoPStore.
+const dpopProofPrefix = "jwt_dpop:"
+
+// dpopAlgorithms are the asymmetric algorithms accepted for DPoP proofs.
+var dpopAlgorithms = []string{"RS256", "PS256", "ES256", "EdDSA"}
+
+// dpopClaims are the claims of a DPoP proof.
+type dpopClaims struct {
+	JTI string `json:"jti"`
+	HTM string `json:"htm"`
+	HTU string `json:"htu"`
+	IAT int64  `json:"iat"`
+	ATH string `json:"ath"`
+}
+
+func (j *JWT) initDPoP() {
+	if !j.DPoP {
+		return
+	}
+
+	if j.DPoPStore == nil {
+		panic("DPoP store is required")
+	}
+
+	if j.DPoPLifetime == 0 {
+		j.DPoPLifetime = time.Minute
+	}
+}
+
+// tokenKeyThumbprint returns the JWK thumbprint the token is bound to by the "cnf" claim.
+// Empty if the token is not bound.
+func tokenKeyThumbprint(claims jwt.MapClaims) string {
+	cnf, _ := claims["cnf"].(map[string]interface{})
+	jkt, _ := cnf["jkt"].(string)
+	return jkt
+}
+
+// checkDPoP checks that a token bound to a client key is presented with the "DPoP"
+// authentication scheme and a valid DPoP proof of the same key.
+// Unbound tokens are accepted as bearer tokens.
+func (j *JWT) checkDPoP(c *mel.Context, tokenStr string, source *tokenSource, claims jwt.MapClaims) error {
+	jkt := tokenKeyThumbprint(claims)
+	isDPoPScheme := strings.EqualFold(source.Scheme, "DPoP")
+
+	if jkt == "" {
+		if isDPoPScheme {
+			return ErrInvalidDPoPProof
+		}
+		return nil
+	}
+
+	if !j.DPoP || !isDPoPScheme {
+		return ErrDPoPProofMissing
+	}
+
+	proofJKT, err := j.verifyDPoPProof(c, tokenStr)
+	if err != nil {
+		return err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(proofJKT), []byte(jkt)) != 1 {
+		return ErrDPoPKeyMismatch
+	}
+	return nil
+}
+
+// verifyDPoPProof verifies the DPoP proof header of the request,
+// and returns the JWK SHA-256 thumbprint of the proof key.
+// If tokenStr is not empty, the proof must carry its hash in the "ath" claim.
+func (j *JWT) verifyDPoPProof(c *mel.Context, tokenStr string) (string, error) {
+	proofs := c.Request.Header["Dpop"]
+	if len(proofs) == 0 {
+		return "", ErrDPoPProofMissing
+	}
+	if len(proofs) > 1 {
+		return "", ErrInvalidDPoPProof
+	}
+
+	object, err := jose.ParseSigned(proofs[0])
+	if err != nil || len(object.Signatures) != 1 {
+		return "", ErrInvalidDPoPProof
+	}
+
+	header := object.Signatures[0].Protected
+	if typ, _ := header.ExtraHeaders[jose.HeaderType].(string); typ != "dpop+jwt" {
+		return "", ErrInvalidDPoPProof
+	}
+
+	jwk := header.JSONWebKey
+	if !containsAny(dpopAlgorithms, []string{header.Algorithm}) || jwk == nil || !jwk.IsPublic() {
+		return "", ErrInvalidDPoPProof
+	}
+
+	payload, err := object.Verify(jwk)
+	if err != nil {
+		return "", ErrInvalidDPoPProof
+	}
+
+	var claims dpopClaims
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.JTI == "" {
+		return "", ErrInvalidDPoPProof
+	}
+
+	if claims.HTM != c.Request.Method || !sameRequestURL(claims.HTU, c) {
+		return "", ErrInvalidDPoPProof
+	}
+
+	window := j.DPoPLifetime + j.Leeway
+	iat := time.Unix(claims.IAT, 0)
+	if time.Since(iat) > window || time.Until(iat) > window {
+		return "", ErrInvalidDPoPProof
+	}
+
+	if tokenStr != "" {
+		sum := sha256.Sum256([]byte(tokenStr))
+		ath := base64.RawURLEncoding.EncodeToString(sum[:])
+		if subtle.ConstantTimeCompare([]byte(claims.ATH), []byte(ath)) != 1 {
+			return "", ErrInvalidDPoPProof
+		}
+	}
+
+	thumbprint, err := jwk.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return "", ErrInvalidDPoPProof
+	}
+	jkt := base64.RawURLEncoding.EncodeToString(thumbprint)
+
+	// A proof is accepted once within its lifetime.
+	sum := sha256.Sum256([]byte(jkt + ":" + claims.JTI))
+	key := dpopProofPrefix + hex.EncodeToString(sum[:])
+
+	if err := j.useDPoPProof(key, 2*window); err != nil {
+		return "", err
+	}
+
+	return jkt, nil
+}
+
+// useDPoPProof records the DPoP proof as used, and returns ErrDPoPProofReused if it has been used.
+// The check is atomic only if DPoPStore is a cache.Adder, or within the process otherwise.
+func (j *JWT) useDPoPProof(key string, expire time.Duration) error {
+	if adder, ok := j.DPoPStore.(cache.Adder); ok {
+		err := adder.Add(key, true, expire)
+		if err == cache.ErrNotStored {
+			return ErrDPoPProofReused
+		}
+		if err != nil {
+			return errors.New("check DPoP proof replay failed")
+		}
+		return nil
+	}
+
+	j.dpopMu.Lock()
+	defer j.dpopMu.Unlock()
+
+	var used bool
+	err := j.DPoPStore.Get(key, &used)
+	if err == nil {
+		return ErrDPoPProofReused
+	}
+	if err != cache.ErrCacheMiss {
+		return errors.New("check DPoP proof replay failed")
+	}
+
+	if err := j.DPoPStore.Set(key, true, expire); err != nil {
+		return errors.New("check DPoP proof replay failed")
+	}
+	return nil
+}
+
+// sameRequestURL reports whether the "htu" claim of a DPoP proof is the URL of the request,
+// ignoring the query and fragment.
+func sameRequestURL(htu string, c *mel.Context) bool {
+	u, err := url.Parse(htu)
+	if err != nil {
+		return false
+	}
+
+	scheme := "http"
+	if c.Request.TLS != nil || strings.EqualFold(c.Request.Header.Get("X-Forwarded-Proto"), "https") {
+		scheme = "https"
+	}
+
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+
+	return strings.EqualFold(u.Scheme, scheme) &&
+		strings.EqualFold(u.Host, c.Request.Host) &&
+		path == c.Request.URL.EscapedPath()
+}
+
+// isDPoPError reports whether the error is about DPoP proofs,
+// which is challenged with the "DPoP" authentication scheme.
+func isDPoPError(err error) bool {
+	return errors.Is(err, ErrDPoPProofMissing) || errors.Is(err, ErrInvalidDPoPProof) ||
+		errors.Is(err, ErrDPoPProofReused) || errors.Is(err, ErrDPoPKeyMismatch)
+}
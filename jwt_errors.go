@@ -0,0 +1,147 @@
+package melware
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/ridewindx/mel"
+)
+
+// Errors of token verification and authorization.
+var (
+	ErrMalformedToken    = errors.New("malformed token")
+	ErrInvalidSignature  = errors.New("invalid token signature")
+	ErrTokenRevoked      = errors.New("token revoked")
+	ErrInsufficientScope = errors.New("insufficient scope")
+	ErrInvalidCSRFToken  = errors.New("invalid CSRF token")
+)
+
+// ErrBackendUnavailable is wrapped by the error of tokens which can't be checked
+// since a backend, e.g., RevocationStore, fails. Such errors are not TokenErrors,
+// and are responded with 503 instead of "invalid_token", so that clients keep the tokens.
+var ErrBackendUnavailable = errors.New("backend unavailable")
+
+// RFC 6750 error codes, and the RFC 9449 error code of DPoP proofs.
+const (
+	ErrorCodeInvalidRequest    = "invalid_request"
+	ErrorCodeInvalidToken      = "invalid_token"
+	ErrorCodeInsufficientScope = "insufficient_scope"
+	ErrorCodeInvalidDPoPProof  = "invalid_dpop_proof"
+)
+
+// TokenError is the error passed to the Unauthorized callback when a token is rejected.
+// Use errors.Is to find out the reason, e.g., errors.Is(err, ErrTokenExpired).
+type TokenError struct {
+	// Code is the RFC 6750 error code, i.e., one of "invalid_request", "invalid_token"
+	// and "insufficient_scope", or "invalid_dpop_proof". Empty if the request has no token.
+	Code string
+
+	// Description is the human readable error description.
+	Description string
+
+	// Scope is the scope required to access the resource, for "insufficient_scope".
+	Scope string
+
+	// Err is the reason, e.g., ErrTokenMissing, ErrTokenExpired or ErrInvalidSignature.
+	Err error
+}
+
+func (e *TokenError) Error() string {
+	return e.Description
+}
+
+func (e *TokenError) Unwrap() error {
+	return e.Err
+}
+
+// Status returns the HTTP status code for the error.
+func (e *TokenError) Status() int {
+	switch e.Code {
+	case ErrorCodeInvalidRequest:
+		return http.StatusBadRequest
+	case ErrorCodeInsufficientScope:
+		return http.StatusForbidden
+	default:
+		return http.StatusUnauthorized
+	}
+}
+
+// newTokenError classifies the error of token extraction or verification.
+func newTokenError(err error) *TokenError {
+	var te *TokenError
+	if errors.As(err, &te) {
+		return te
+	}
+
+	if ve, ok := err.(*jwt.ValidationError); ok {
+		switch {
+		case ve.Errors&jwt.ValidationErrorMalformed != 0:
+			err = ErrMalformedToken
+		case ve.Errors&jwt.ValidationErrorSignatureInvalid != 0:
+			err = ErrInvalidSignature
+		case ve.Inner != nil:
+			err = ve.Inner
+		}
+	}
+
+	te = &TokenError{
+		Code:        ErrorCodeInvalidToken,
+		Description: err.Error(),
+		Err:         err,
+	}
+
+	switch err {
+	case ErrTokenMissing:
+		// No error code for requests without authentication information.
+		te.Code = ""
+	case ErrInvalidAuthHeader:
+		te.Code = ErrorCodeInvalidRequest
+	case ErrInvalidDPoPProof, ErrDPoPProofReused:
+		te.Code = ErrorCodeInvalidDPoPProof
+	}
+
+	return te
+}
+
+// rejectToken responds with the RFC 6750 error of the rejected token.
+// Tokens which can't be checked because of backend failures are responded with 503.
+func (j *JWT) rejectToken(c *mel.Context, err error) {
+	if errors.Is(err, ErrBackendUnavailable) {
+		c.Abort()
+		j.Unauthorized(c, http.StatusServiceUnavailable, err)
+		return
+	}
+
+	te := newTokenError(err)
+	j.unauthorized(c, te.Status(), te)
+}
+
+// challenge returns the WWW-Authenticate header value for the error.
+func (j *JWT) challenge(err error) string {
+	scheme := "Bearer"
+	if isDPoPError(err) {
+		scheme = "DPoP"
+	}
+
+	challenge := scheme + " realm=" + quote(j.Realm)
+	if scheme == "DPoP" {
+		challenge += ", algs=" + quote(strings.Join(dpopAlgorithms, " "))
+	}
+
+	var te *TokenError
+	if errors.As(err, &te) && te.Code != "" {
+		challenge += ", error=" + quote(te.Code) + ", error_description=" + quote(te.Description)
+		if te.Scope != "" {
+			challenge += ", scope=" + quote(te.Scope)
+		}
+	}
+
+	return challenge
+}
+
+// quote returns the string as an HTTP quoted-string.
+func quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
@@ -0,0 +1,106 @@
+package melware
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/ridewindx/mel"
+)
+
+// Claims copied into introspection responses if present in the token.
+var introspectionClaims = []string{"exp", "iat", "nbf", "iss", "aud", "jti", "cnf"}
+
+// IntrospectionHandler returns an RFC 7662 token introspection endpoint
+// for services which can't validate tokens locally.
+// The token is posted as the "token" form field, and validated with the same rules as Middleware.
+// Reply will be of the form {"active": true, "sub": "USER_ID", "exp": EXP, ...},
+// or {"active": false} if the token is not valid.
+// Callers authenticate with the client credentials in IntrospectionClients,
+// either by HTTP Basic authentication or the "client_id" and "client_secret" form fields.
+func (j *JWT) IntrospectionHandler() mel.Handler {
+	j.init()
+
+	if len(j.IntrospectionClients) == 0 {
+		panic("Introspection clients are required")
+	}
+
+	return func(c *mel.Context) {
+		c.Header("Cache-Control", "no-store")
+
+		clientID, ok := j.authenticateClient(c)
+		if !ok {
+			c.Header("WWW-Authenticate", "Basic realm="+quote(j.Realm))
+			c.JSON(http.StatusUnauthorized, mel.Map{
+				"error": "invalid_client",
+			})
+			return
+		}
+
+		tokenStr := c.Request.PostFormValue("token")
+		if tokenStr == "" {
+			c.JSON(http.StatusBadRequest, mel.Map{
+				"error": ErrorCodeInvalidRequest,
+			})
+			return
+		}
+
+		token, err := j.verifyToken(tokenStr)
+		if err != nil {
+			c.JSON(http.StatusOK, mel.Map{"active": false})
+			return
+		}
+
+		userID, _, err := j.checkToken(token)
+		if errors.Is(err, ErrBackendUnavailable) {
+			c.JSON(http.StatusServiceUnavailable, mel.Map{"error": "temporarily_unavailable"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusOK, mel.Map{"active": false})
+			return
+		}
+
+		claims := token.Claims.(jwt.MapClaims)
+		resp := mel.Map{
+			"active":     true,
+			"sub":        userID,
+			"token_type": "Bearer",
+			"client_id":  clientID,
+		}
+		if tokenKeyThumbprint(claims) != "" {
+			resp["token_type"] = "DPoP"
+		}
+		for _, name := range introspectionClaims {
+			if v, ok := claims[name]; ok {
+				resp[name] = v
+			}
+		}
+		if scopes, _ := stringOrArray(claims, j.ScopeClaim); len(scopes) > 0 {
+			resp["scope"] = strings.Join(splitScopes(scopes), " ")
+		}
+
+		c.JSON(http.StatusOK, resp)
+	}
+}
+
+// authenticateClient authenticates the caller with the client credentials.
+func (j *JWT) authenticateClient(c *mel.Context) (string, bool) {
+	clientID, secret, ok := c.Request.BasicAuth()
+	if !ok {
+		clientID = c.Request.PostFormValue("client_id")
+		secret = c.Request.PostFormValue("client_secret")
+	}
+
+	expected, found := j.IntrospectionClients[clientID]
+	if !found || clientID == "" {
+		return "", false
+	}
+
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(expected)) != 1 {
+		return "", false
+	}
+	return clientID, true
+}
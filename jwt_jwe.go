@@ -0,0 +1,109 @@
+package melware
+
+import (
+	"crypto/rsa"
+	"errors"
+	"strings"
+
+	"gopkg.in/square/go-jose.v2"
+)
+
+// ErrDecryptToken is the error of encrypted tokens which can't be decrypted.
+var ErrDecryptToken = errors.New("decrypt token failed")
+
+func (j *JWT) initEncryption() {
+	if j.DecryptionKey == nil {
+		if key, ok := j.EncryptionKey.([]byte); ok {
+			j.DecryptionKey = key
+		}
+	}
+
+	for _, key := range []interface{}{j.EncryptionKey, j.DecryptionKey} {
+		switch k := key.(type) {
+		case nil, *rsa.PublicKey, *rsa.PrivateKey:
+		case []byte:
+			if len(k) != 32 {
+				panic("Encryption key must be 32 bytes for A256GCM")
+			}
+		default:
+			panic("Invalid encryption key type")
+		}
+	}
+
+	if j.EncryptionAlgorithm == "" {
+		switch j.EncryptionKey.(type) {
+		case []byte:
+			j.EncryptionAlgorithm = string(jose.DIRECT)
+		case *rsa.PublicKey:
+			j.EncryptionAlgorithm = string(jose.RSA_OAEP)
+		}
+	}
+
+	switch jose.KeyAlgorithm(j.EncryptionAlgorithm) {
+	case "", jose.DIRECT, jose.RSA_OAEP, jose.RSA_OAEP_256:
+	default:
+		panic("Invalid encryption algorithm")
+	}
+}
+
+// encryptToken encrypts the signed token into a nested JWE token with A256GCM.
+func (j *JWT) encryptToken(tokenStr string) (string, error) {
+	recipient := jose.Recipient{
+		Algorithm: jose.KeyAlgorithm(j.EncryptionAlgorithm),
+		Key:       j.EncryptionKey,
+	}
+	options := (&jose.EncrypterOptions{}).WithType("JWT").WithContentType("JWT")
+
+	encrypter, err := jose.NewEncrypter(jose.A256GCM, recipient, options)
+	if err != nil {
+		return "", err
+	}
+
+	object, err := encrypter.Encrypt([]byte(tokenStr))
+	if err != nil {
+		return "", err
+	}
+	return object.CompactSerialize()
+}
+
+// isEncrypted reports whether the token is in the JWE compact serialization,
+// which has five parts instead of three.
+func isEncrypted(tokenStr string) bool {
+	return strings.Count(tokenStr, ".") == 4
+}
+
+// decryptToken decrypts a nested JWE token into the signed token.
+func (j *JWT) decryptToken(tokenStr string) (string, error) {
+	if j.DecryptionKey == nil {
+		return "", ErrDecryptToken
+	}
+
+	object, err := jose.ParseEncrypted(tokenStr)
+	if err != nil {
+		return "", ErrMalformedToken
+	}
+
+	// Only accept the algorithms of our own key,
+	// go-jose picks the key management algorithm from the header.
+	alg := jose.KeyAlgorithm(object.Header.Algorithm)
+	switch j.DecryptionKey.(type) {
+	case []byte:
+		if alg != jose.DIRECT {
+			return "", ErrDecryptToken
+		}
+	case *rsa.PrivateKey:
+		if alg != jose.RSA_OAEP && alg != jose.RSA_OAEP_256 {
+			return "", ErrDecryptToken
+		}
+	}
+
+	if enc, _ := object.Header.ExtraHeaders[jose.HeaderKey("enc")].(string); enc != string(jose.A256GCM) {
+		return "", ErrDecryptToken
+	}
+
+	plaintext, err := object.Decrypt(j.DecryptionKey)
+	if err != nil {
+		return "", ErrDecryptToken
+	}
+	return string(plaintext), nil
+}
@@ -0,0 +1,273 @@
+package melware
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/ridewindx/mel"
+	"gopkg.in/square/go-jose.v2"
+)
+
+// JWKS returns the public keys of the key set as a JSON Web Key Set.
+// HMAC keys and expired keys are not included.
+func (j *JWT) JWKS() *jose.JSONWebKeySet {
+	set := &jose.JSONWebKeySet{
+		Keys: []jose.JSONWebKey{},
+	}
+
+	for _, key := range j.keys {
+		if isHMAC(key.Algorithm) || key.expired() {
+			continue
+		}
+		set.Keys = append(set.Keys, jose.JSONWebKey{
+			Key:       key.PublicKey,
+			KeyID:     key.ID,
+			Algorithm: key.Algorithm,
+			Use:       "sig",
+		})
+	}
+
+	return set
+}
+
+// JWKSHandler returns a handler that serves the public keys as a JSON Web Key Set,
+// which is usually put under the "/.well-known/jwks.json" endpoint.
+func (j *JWT) JWKSHandler() mel.Handler {
+	j.init()
+
+	return func(c *mel.Context) {
+		c.Header("Cache-Control", "public, max-age=300")
+		c.JSON(http.StatusOK, j.JWKS())
+	}
+}
+
+// RemoteKeySet fetches and caches the JSON Web Key Set of an external identity provider.
+// Cached keys are refreshed when a token refers to an unknown key ID,
+// or when they are older than MaxAge, in which case they are still used until new ones arrive.
+// Concurrent refreshes are coalesced into a single fetch.
+type RemoteKeySet struct {
+	// URL specifies the JWKS URL.
+	// Optional if DiscoveryURL is set.
+	URL string
+
+	// DiscoveryURL specifies the OpenID Connect discovery document URL,
+	// e.g., "https://idp.example.com/.well-known/openid-configuration".
+	// The JWKS URL is taken from its "jwks_uri" field.
+	// Optional. Used only if URL is empty.
+	DiscoveryURL string
+
+	// Client specifies the HTTP client for fetching documents.
+	// Optional. Defaults to a client with a 10 seconds timeout.
+	Client *http.Client
+
+	// MaxAge specifies the duration that fetched keys are cached.
+	// Optional. Defaults to one hour.
+	MaxAge time.Duration
+
+	// MinRefreshInterval specifies the minimal duration between two fetches,
+	// which prevents tokens with unknown key IDs from flooding the identity provider.
+	// Optional. Defaults to one minute.
+	MinRefreshInterval time.Duration
+
+	mu         sync.Mutex
+	jwksURL    string
+	keys       []jose.JSONWebKey
+	fetchedAt  time.Time
+	triedAt    time.Time
+	refreshing chan struct{} // closed when the ongoing refresh is done, nil if none
+	refreshErr error         // error of the last refresh
+}
+
+// NewRemoteKeySet returns a new RemoteKeySet which fetches keys from the JWKS URL.
+func NewRemoteKeySet(url string) *RemoteKeySet {
+	return &RemoteKeySet{
+		URL: url,
+	}
+}
+
+// NewDiscoveryKeySet returns a new RemoteKeySet which fetches keys from the JWKS URL
+// found in the OpenID Connect discovery document.
+func NewDiscoveryKeySet(discoveryURL string) *RemoteKeySet {
+	return &RemoteKeySet{
+		DiscoveryURL: discoveryURL,
+	}
+}
+
+// Key returns the public key with the key ID.
+// If kid is empty and the key set has exactly one key, that key is returned.
+func (s *RemoteKeySet) Key(kid string) (*jose.JSONWebKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	maxAge := s.MaxAge
+	if maxAge == 0 {
+		maxAge = time.Hour
+	}
+
+	minInterval := s.MinRefreshInterval
+	if minInterval == 0 {
+		minInterval = time.Minute
+	}
+
+	if time.Since(s.fetchedAt) > maxAge && time.Since(s.triedAt) > minInterval {
+		done := s.startRefresh()
+		// Keep using the stale keys until new ones arrive,
+		// or if the identity provider is unavailable.
+		if len(s.keys) == 0 {
+			s.wait(done)
+			if len(s.keys) == 0 {
+				return nil, s.refreshErr
+			}
+		}
+	}
+
+	key := s.find(kid)
+
+	// Unknown key, the identity provider may have rotated its keys.
+	if key == nil && (s.refreshing != nil || time.Since(s.triedAt) > minInterval) {
+		s.wait(s.startRefresh())
+		if s.refreshErr != nil {
+			return nil, s.refreshErr
+		}
+		key = s.find(kid)
+	}
+
+	if key == nil {
+		return nil, errors.New("unknown signing key")
+	}
+	return key, nil
+}
+
+// startRefresh starts fetching the keys in the background unless a refresh is ongoing,
+// and returns the channel closed when the refresh is done.
+// s.mu must be held.
+func (s *RemoteKeySet) startRefresh() chan struct{} {
+	if s.refreshing != nil {
+		return s.refreshing
+	}
+
+	done := make(chan struct{})
+	s.refreshing = done
+	s.triedAt = time.Now()
+	jwksURL := s.jwksURL
+
+	go func() {
+		jwksURL, keys, err := s.load(jwksURL)
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.jwksURL = jwksURL
+		if err == nil {
+			s.keys = keys
+			s.fetchedAt = time.Now()
+		}
+		s.refreshErr = err
+		s.refreshing = nil
+		close(done)
+	}()
+	return done
+}
+
+// wait releases s.mu until the refresh is done.
+func (s *RemoteKeySet) wait(done chan struct{}) {
+	s.mu.Unlock()
+	<-done
+	s.mu.Lock()
+}
+
+func (s *RemoteKeySet) find(kid string) *jose.JSONWebKey {
+	if kid == "" {
+		if len(s.keys) == 1 {
+			return &s.keys[0]
+		}
+		return nil
+	}
+
+	for i := range s.keys {
+		if s.keys[i].KeyID == kid {
+			return &s.keys[i]
+		}
+	}
+	return nil
+}
+
+// load fetches the signing keys from the JWKS URL,
+// which is discovered first if empty. It returns the JWKS URL for next loads.
+func (s *RemoteKeySet) load(jwksURL string) (string, []jose.JSONWebKey, error) {
+	if jwksURL == "" {
+		jwksURL = s.URL
+	}
+
+	if jwksURL == "" {
+		if s.DiscoveryURL == "" {
+			return "", nil, errors.New("JWKS URL or discovery URL is required")
+		}
+
+		var discovery struct {
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := s.fetch(s.DiscoveryURL, &discovery); err != nil {
+			return "", nil, err
+		}
+		if discovery.JWKSURI == "" {
+			return "", nil, errors.New("no jwks_uri in discovery document")
+		}
+		jwksURL = discovery.JWKSURI
+	}
+
+	var set jose.JSONWebKeySet
+	if err := s.fetch(jwksURL, &set); err != nil {
+		return jwksURL, nil, err
+	}
+
+	keys := set.Keys[:0]
+	for _, key := range set.Keys {
+		if key.IsPublic() && (key.Use == "" || key.Use == "sig") {
+			keys = append(keys, key)
+		}
+	}
+	return jwksURL, keys, nil
+}
+
+func (s *RemoteKeySet) fetch(url string, v interface{}) error {
+	client := s.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetch %s: %s", url, resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// remoteVerificationKey finds the key for verifying the token in the remote key set.
+func (j *JWT) remoteVerificationKey(token *jwt.Token) (interface{}, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+		return nil, errors.New("invalid signing algorithm")
+	}
+
+	kid, _ := token.Header["kid"].(string)
+	key, err := j.RemoteKeys.Key(kid)
+	if err != nil {
+		return nil, err
+	}
+
+	if key.Algorithm != "" && key.Algorithm != token.Method.Alg() {
+		return nil, errors.New("invalid signing algorithm")
+	}
+
+	return key.Key, nil
+}
@@ -0,0 +1,238 @@
+package melware
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// JWTKey is a key in a JWT key set, identified by its ID.
+type JWTKey struct {
+	// ID specifies the key ID put into the "kid" header of tokens signed with this key.
+	ID string
+
+	// Algorithm specifies the signing algorithm of this key.
+	// Optional. Defaults to JWT.SigningAlgorithm.
+	Algorithm string
+
+	// Key specifies the secret key for HMAC algorithms.
+	Key []byte
+
+	// PrivateKey specifies the signing key for asymmetric algorithms.
+	// Optional for keys only used for verification.
+	PrivateKey crypto.PrivateKey
+
+	// PublicKey specifies the verification key for asymmetric algorithms.
+	// Optional. Defaults to the public half of PrivateKey.
+	PublicKey crypto.PublicKey
+
+	// PrivateKeyFile specifies a PEM file to load PrivateKey from.
+	PrivateKeyFile string
+
+	// PublicKeyFile specifies a PEM file to load PublicKey from.
+	PublicKeyFile string
+
+	// Expires specifies the time after which tokens signed with this key are rejected.
+	// Optional. Zero means the key never expires.
+	Expires time.Time
+}
+
+func (k *JWTKey) init(defaultAlgorithm string) {
+	if k.Algorithm == "" {
+		k.Algorithm = defaultAlgorithm
+	}
+
+	if jwt.GetSigningMethod(k.Algorithm) == nil {
+		panic("Invalid signing algorithm")
+	}
+
+	if isHMAC(k.Algorithm) {
+		if k.Key == nil {
+			panic("Secret key is required")
+		}
+		return
+	}
+
+	var err error
+
+	if k.PrivateKey == nil && k.PrivateKeyFile != "" {
+		k.PrivateKey, err = LoadPrivateKeyFile(k.PrivateKeyFile)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if k.PublicKey == nil && k.PublicKeyFile != "" {
+		k.PublicKey, err = LoadPublicKeyFile(k.PublicKeyFile)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if k.PublicKey == nil && k.PrivateKey != nil {
+		k.PublicKey = publicKeyOf(k.PrivateKey)
+	}
+
+	if k.PublicKey == nil {
+		panic("Public key or private key is required")
+	}
+}
+
+// signingKey returns the key used for creating tokens.
+func (k *JWTKey) signingKey() interface{} {
+	if isHMAC(k.Algorithm) {
+		return k.Key
+	}
+	return k.PrivateKey
+}
+
+// verificationKey returns the key used for verifying tokens.
+func (k *JWTKey) verificationKey() interface{} {
+	if isHMAC(k.Algorithm) {
+		return k.Key
+	}
+	return k.PublicKey
+}
+
+func (k *JWTKey) expired() bool {
+	return !k.Expires.IsZero() && time.Now().After(k.Expires)
+}
+
+// SigningMethodEdDSA implements the EdDSA signing method with Ed25519 keys.
+// Expects ed25519.PrivateKey for signing and ed25519.PublicKey for verification.
+var SigningMethodEdDSA = &signingMethodEdDSA{}
+
+func init() {
+	jwt.RegisterSigningMethod(SigningMethodEdDSA.Alg(), func() jwt.SigningMethod {
+		return SigningMethodEdDSA
+	})
+}
+
+type signingMethodEdDSA struct{}
+
+func (m *signingMethodEdDSA) Alg() string {
+	return "EdDSA"
+}
+
+func (m *signingMethodEdDSA) Verify(signingString, signature string, key interface{}) error {
+	var publicKey ed25519.PublicKey
+	switch k := key.(type) {
+	case ed25519.PublicKey:
+		publicKey = k
+	case *ed25519.PublicKey:
+		publicKey = *k
+	default:
+		return jwt.ErrInvalidKeyType
+	}
+
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+
+	if !ed25519.Verify(publicKey, []byte(signingString), sig) {
+		return jwt.ErrSignatureInvalid
+	}
+	return nil
+}
+
+func (m *signingMethodEdDSA) Sign(signingString string, key interface{}) (string, error) {
+	var privateKey ed25519.PrivateKey
+	switch k := key.(type) {
+	case ed25519.PrivateKey:
+		privateKey = k
+	case *ed25519.PrivateKey:
+		privateKey = *k
+	default:
+		return "", jwt.ErrInvalidKeyType
+	}
+
+	return jwt.EncodeSegment(ed25519.Sign(privateKey, []byte(signingString))), nil
+}
+
+// ParsePrivateKeyPEM parses a PEM encoded RSA, ECDSA or Ed25519 private key.
+// PKCS#1, PKCS#8 and SEC 1 encodings are supported.
+func ParsePrivateKeyPEM(data []byte) (crypto.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("invalid PEM data")
+	}
+
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	return nil, errors.New("unsupported private key type")
+}
+
+// ParsePublicKeyPEM parses a PEM encoded RSA, ECDSA or Ed25519 public key.
+// PKIX, PKCS#1 and X.509 certificate encodings are supported.
+func ParsePublicKeyPEM(data []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("invalid PEM data")
+	}
+
+	if key, err := x509.ParsePKIXPublicKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS1PublicKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+		return cert.PublicKey, nil
+	}
+	return nil, errors.New("unsupported public key type")
+}
+
+// LoadPrivateKeyFile reads and parses a PEM encoded private key file.
+func LoadPrivateKeyFile(path string) (crypto.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePrivateKeyPEM(data)
+}
+
+// LoadPublicKeyFile reads and parses a PEM encoded public key or certificate file.
+func LoadPublicKeyFile(path string) (crypto.PublicKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePublicKeyPEM(data)
+}
+
+// publicKeyOf returns the public half of a private key.
+func publicKeyOf(key crypto.PrivateKey) crypto.PublicKey {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return &k.PublicKey
+	case *ecdsa.PrivateKey:
+		return &k.PublicKey
+	case ed25519.PrivateKey:
+		return k.Public()
+	case crypto.Signer:
+		return k.Public()
+	}
+	return nil
+}
+
+// isHMAC reports whether alg is a symmetric signing algorithm.
+func isHMAC(alg string) bool {
+	_, ok := jwt.GetSigningMethod(alg).(*jwt.SigningMethodHMAC)
+	return ok
+}
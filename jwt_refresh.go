@@ -0,0 +1,253 @@
+package melware
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ridewindx/mel"
+	"github.com/ridewindx/melware/cache"
+)
+
+// Errors of refresh token exchange.
+var (
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	ErrRefreshTokenReused  = errors.New("refresh token reused")
+)
+
+// Key prefixes for storing refresh tokens and revoked token families into RefreshStore.
+const (
+	refreshTokenPrefix  = "jwt_refresh:"
+	refreshFamilyPrefix = "jwt_refresh_family:"
+)
+
+// refreshRecord is the stored state of a refresh token.
+type refreshRecord struct {
+	UserID string
+
+	// Family identifies all refresh tokens rotated from the same login.
+	Family string
+
+	// Used reports whether the refresh token has been rotated.
+	Used bool
+
+	// Version is the token version of the user when the family was created.
+	Version int
+
+	// JKT is the JWK thumbprint of the client key that the family is bound to by DPoP.
+	JKT string
+
+	Expires time.Time
+}
+
+// refreshTokenKey returns the store key of the refresh token.
+// Only the hash of the token is stored, so a leaked store can't be used to refresh.
+func refreshTokenKey(refreshToken string) string {
+	sum := sha256.Sum256([]byte(refreshToken))
+	return refreshTokenPrefix + hex.EncodeToString(sum[:])
+}
+
+// createRefreshToken creates and stores a new refresh token in the token family.
+func (j *JWT) createRefreshToken(userID, family, jkt string) (string, error) {
+	refreshToken := newTokenID() + newTokenID()
+
+	rec := refreshRecord{
+		UserID:  userID,
+		Family:  family,
+		JKT:     jkt,
+		Expires: time.Now().Add(j.RefreshTimeout),
+	}
+
+	if j.TokenVersion != nil {
+		version, err := j.currentTokenVersion(userID)
+		if err != nil {
+			return "", err
+		}
+		rec.Version = version
+	}
+	err := j.RefreshStore.Set(refreshTokenKey(refreshToken), rec, expireIn(rec.Expires))
+	if err != nil {
+		return "", err
+	}
+	return refreshToken, nil
+}
+
+// claimRefreshToken marks the refresh token as used,
+// and reports whether it has already been used by a concurrent request.
+// The check is atomic only if RefreshStore is a cache.Adder, or within the process otherwise.
+func (j *JWT) claimRefreshToken(key string, rec refreshRecord) (bool, error) {
+	if adder, ok := j.RefreshStore.(cache.Adder); ok {
+		err := adder.Add(key+":used", true, expireIn(rec.Expires))
+		if err == cache.ErrNotStored {
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	} else {
+		j.refreshMu.Lock()
+		defer j.refreshMu.Unlock()
+
+		var current refreshRecord
+		if err := j.RefreshStore.Get(key, &current); err != nil {
+			return false, err
+		}
+		if current.Used {
+			return true, nil
+		}
+	}
+
+	rec.Used = true
+	return false, j.RefreshStore.Set(key, rec, expireIn(rec.Expires))
+}
+
+// revokeRefreshFamily revokes all refresh tokens in the token family.
+func (j *JWT) revokeRefreshFamily(family string) error {
+	return j.RefreshStore.Set(refreshFamilyPrefix+family, true, j.RefreshTimeout)
+}
+
+func (j *JWT) refreshFamilyRevoked(family string) (bool, error) {
+	var revoked bool
+	err := j.RefreshStore.Get(refreshFamilyPrefix+family, &revoked)
+	if err == cache.ErrCacheMiss {
+		return false, nil
+	}
+	return revoked, err
+}
+
+// RefreshTokenHandler can be used by clients to exchange a refresh token for a new token pair.
+// The refresh token is posted as the "refresh_token" form or json field.
+// Reply will be of the form {"token": "TOKEN", "refresh_token": "REFRESH_TOKEN"}.
+// In cookie mode, the refresh token is read from the refresh token cookie first,
+// and the new one is set in the cookie instead.
+// The posted refresh token is invalidated, and presenting it again is treated as token theft,
+// which revokes all refresh tokens rotated from the same login.
+// Requires RefreshStore.
+func (j *JWT) RefreshTokenHandler() mel.Handler {
+	j.init()
+
+	if j.RefreshStore == nil {
+		panic("Refresh store is required")
+	}
+
+	if j.activeKey == nil || j.activeKey.signingKey() == nil {
+		panic("Private key is required for signing")
+	}
+
+	return func(c *mel.Context) {
+		refreshToken := j.refreshTokenFromRequest(c)
+		if refreshToken == "" {
+			j.unauthorized(c, http.StatusUnauthorized, ErrInvalidRefreshToken)
+			return
+		}
+
+		key := refreshTokenKey(refreshToken)
+
+		var rec refreshRecord
+		err := j.RefreshStore.Get(key, &rec)
+		if err != nil || time.Now().After(rec.Expires) {
+			j.unauthorized(c, http.StatusUnauthorized, ErrInvalidRefreshToken)
+			return
+		}
+
+		revoked, err := j.refreshFamilyRevoked(rec.Family)
+		if err != nil || revoked {
+			j.unauthorized(c, http.StatusUnauthorized, ErrInvalidRefreshToken)
+			return
+		}
+
+		if rec.Used {
+			// Reuse of a rotated token means it has been stolen,
+			// so kill the whole family including the token the thief or the user holds now.
+			j.revokeRefreshFamily(rec.Family)
+			j.unauthorized(c, http.StatusUnauthorized, ErrRefreshTokenReused)
+			return
+		}
+
+		if j.TokenVersion != nil {
+			version, err := j.currentTokenVersion(rec.UserID)
+			if err != nil {
+				j.rejectToken(c, fmt.Errorf("check token version failed: %w", ErrBackendUnavailable))
+				return
+			}
+			if version != rec.Version {
+				j.unauthorized(c, http.StatusUnauthorized, ErrStaleTokenVersion)
+				return
+			}
+		}
+
+		// Refresh tokens bound to a client key require a DPoP proof of the same key.
+		if rec.JKT != "" {
+			jkt, err := j.verifyDPoPProof(c, "")
+			if err == nil && jkt != rec.JKT {
+				err = ErrDPoPKeyMismatch
+			}
+			if err != nil {
+				j.rejectToken(c, err)
+				return
+			}
+		}
+
+		used, err := j.claimRefreshToken(key, rec)
+		if err != nil {
+			j.unauthorized(c, http.StatusUnauthorized, errors.New("Rotate refresh token failed"))
+			return
+		}
+		if used {
+			// Lost the race to a concurrent use of the same token.
+			j.revokeRefreshFamily(rec.Family)
+			j.unauthorized(c, http.StatusUnauthorized, ErrRefreshTokenReused)
+			return
+		}
+
+		tokenStr, claims, err := j.createToken(rec.UserID, rec.JKT)
+		if err != nil {
+			j.unauthorized(c, http.StatusUnauthorized, errors.New("Create JWT token failed"))
+			return
+		}
+
+		newRefreshToken, err := j.createRefreshToken(rec.UserID, rec.Family, rec.JKT)
+		if err != nil {
+			j.unauthorized(c, http.StatusUnauthorized, errors.New("Create refresh token failed"))
+			return
+		}
+
+		resp := j.tokenResponse(c, tokenStr, claims)
+		j.refreshTokenResponse(c, resp, newRefreshToken)
+		c.JSON(http.StatusOK, resp)
+	}
+}
+
+// refreshTokenResponse adds the refresh token to the reply of a newly created token.
+// In cookie mode, the refresh token is set as a cookie instead, so that it is not readable by JavaScript.
+func (j *JWT) refreshTokenResponse(c *mel.Context, resp mel.Map, refreshToken string) {
+	if j.SendCookie {
+		j.setRefreshCookie(c, refreshToken)
+		return
+	}
+	resp["refresh_token"] = refreshToken
+}
+
+// refreshTokenFromRequest reads the refresh token from the refresh token cookie in cookie mode,
+// or from a form or json request body.
+func (j *JWT) refreshTokenFromRequest(c *mel.Context) string {
+	if j.SendCookie {
+		if refreshToken, err := c.Cookie(j.RefreshCookieName); err == nil && refreshToken != "" {
+			return refreshToken
+		}
+	}
+
+	if strings.HasPrefix(c.Request.Header.Get("Content-Type"), "application/json") {
+		var body struct {
+			RefreshToken string `json:"refresh_token"`
+		}
+		json.NewDecoder(c.Request.Body).Decode(&body)
+		return body.RefreshToken
+	}
+	return c.Request.PostFormValue("refresh_token")
+}
@@ -0,0 +1,97 @@
+package melware
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/ridewindx/mel"
+	"github.com/ridewindx/melware/cache"
+)
+
+// Key prefix for storing revoked token IDs into RevocationStore.
+const revokedTokenPrefix = "jwt_revoked:"
+
+// newTokenID returns a random token ID for the "jti" claim.
+func newTokenID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// Revoke revokes the token of the current request until it expires.
+// Shall be put under an endpoint that is using the Middleware.
+func (j *JWT) Revoke(c *mel.Context) error {
+	claims := j.ExtractClaims(c)
+	if claims == nil {
+		return errors.New("no JWT claims in context")
+	}
+
+	return j.revokeClaims(claims)
+}
+
+// revokeClaims revokes the token with the claims until it expires.
+func (j *JWT) revokeClaims(claims jwt.MapClaims) error {
+	jti, _ := claims["jti"].(string)
+	if jti == "" {
+		return errors.New("token has no jti claim")
+	}
+
+	var until time.Time
+	if exp, ok := claims["exp"].(float64); ok {
+		until = time.Unix(int64(exp), 0)
+	}
+	return j.RevokeToken(jti, until)
+}
+
+// RevokeToken revokes the token with the token ID until the specified time,
+// which is usually the expiration time of the token.
+// A zero until revokes the token forever.
+func (j *JWT) RevokeToken(jti string, until time.Time) error {
+	if j.RevocationStore == nil {
+		return errors.New("revocation store is not configured")
+	}
+
+	expire := cache.FOREVER
+	if !until.IsZero() {
+		if time.Now().After(until) {
+			// Already expired, nothing to revoke.
+			return nil
+		}
+		expire = expireIn(until)
+	}
+
+	return j.RevocationStore.Set(revokedTokenPrefix+jti, true, expire)
+}
+
+// expireIn returns the duration until the time for storing items into cache.Store,
+// rounded up to whole seconds, which is the resolution of Redis.
+// It is at least one second, since zero means the default expiration of the store.
+func expireIn(until time.Time) time.Duration {
+	d := time.Until(until)
+	if d < time.Second {
+		return time.Second
+	}
+	return (d + time.Second - 1).Truncate(time.Second)
+}
+
+// isRevoked checks whether the token with the token ID has been revoked.
+func (j *JWT) isRevoked(jti string) (bool, error) {
+	if j.RevocationStore == nil || jti == "" {
+		return false, nil
+	}
+
+	var revoked bool
+	err := j.RevocationStore.Get(revokedTokenPrefix+jti, &revoked)
+	if err == cache.ErrCacheMiss {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return revoked, nil
+}
@@ -0,0 +1,81 @@
+package melware
+
+import (
+	"strings"
+
+	"github.com/ridewindx/mel"
+)
+
+// RequireScopes returns a middleware that allows only tokens granted all the scopes.
+// The scopes are read from the ScopeClaim claim, which is either a space-delimited string
+// or an array of strings.
+// Shall be put after Middleware.
+// On failure, a 403 HTTP response with an RFC 6750 "insufficient_scope" challenge is returned.
+func (j *JWT) RequireScopes(scopes ...string) mel.Handler {
+	j.init()
+
+	return func(c *mel.Context) {
+		claims := j.ExtractClaims(c)
+		if claims == nil {
+			j.rejectToken(c, ErrTokenMissing)
+			return
+		}
+
+		granted, _ := stringOrArray(claims, j.ScopeClaim)
+		granted = splitScopes(granted)
+
+		for _, scope := range scopes {
+			if !containsAny(granted, []string{scope}) {
+				j.rejectToken(c, &TokenError{
+					Code:        ErrorCodeInsufficientScope,
+					Description: "requires scope " + scope,
+					Scope:       strings.Join(scopes, " "),
+					Err:         ErrInsufficientScope,
+				})
+				return
+			}
+		}
+
+		c.Next()
+	}
+}
+
+// RequireRoles returns a middleware that allows only tokens granted any of the roles.
+// The roles are read from the RolesClaim claim, which is either an array of strings
+// or a space-delimited string.
+// Shall be put after Middleware.
+// On failure, a 403 HTTP response with an RFC 6750 "insufficient_scope" challenge is returned.
+func (j *JWT) RequireRoles(roles ...string) mel.Handler {
+	j.init()
+
+	return func(c *mel.Context) {
+		claims := j.ExtractClaims(c)
+		if claims == nil {
+			j.rejectToken(c, ErrTokenMissing)
+			return
+		}
+
+		granted, _ := stringOrArray(claims, j.RolesClaim)
+		granted = splitScopes(granted)
+
+		if !containsAny(granted, roles) {
+			j.rejectToken(c, &TokenError{
+				Code:        ErrorCodeInsufficientScope,
+				Description: "requires role " + strings.Join(roles, " or "),
+				Err:         ErrInsufficientScope,
+			})
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// splitScopes splits space-delimited scopes.
+func splitScopes(values []string) []string {
+	var scopes []string
+	for _, v := range values {
+		scopes = append(scopes, strings.Fields(v)...)
+	}
+	return scopes
+}
@@ -0,0 +1,1150 @@
+package melware
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/ridewindx/mel"
+	"github.com/ridewindx/melware/cache"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/square/go-jose.v2"
+)
+
+func newJWTTestApp(issuer, verifier *JWT) *mel.Mel {
+	app := mel.New()
+	if issuer != nil {
+		app.Post("/login", issuer.LoginHandler())
+	}
+	app.Get("/auth", verifier.Middleware(), func(c *mel.Context) {
+		c.Text(200, c.MustGet("userID").(string))
+	})
+	return app
+}
+
+func jwtLogin(t *testing.T, app http.Handler) string {
+	req, _ := http.NewRequest("POST", "/login", nil)
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	var resp struct {
+		Token string `json:"token"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.NotEmpty(t, resp.Token)
+	return resp.Token
+}
+
+func jwtRequest(app http.Handler, method, path, token string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, path, nil)
+	if len(token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, req)
+	return w
+}
+
+func testAuthenticate(c *mel.Context) (string, error) {
+	return "alice", nil
+}
+
+func TestJWTHMAC(t *testing.T) {
+	j := &JWT{
+		Key:          []byte("secret"),
+		Authenticate: testAuthenticate,
+	}
+	app := newJWTTestApp(j, j)
+
+	token := jwtLogin(t, app)
+
+	w := jwtRequest(app, "GET", "/auth", token)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "alice", w.Body.String())
+
+	w = jwtRequest(app, "GET", "/auth", token+"x")
+	assert.Equal(t, 401, w.Code)
+
+	w = jwtRequest(app, "GET", "/auth", "")
+	assert.Equal(t, 401, w.Code)
+}
+
+func TestJWTAsymmetric(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	for alg, key := range map[string]interface{}{
+		"RS256": rsaKey,
+		"PS256": rsaKey,
+		"ES256": ecKey,
+		"EdDSA": edKey,
+	} {
+		der, err := x509.MarshalPKIXPublicKey(publicKeyOf(key))
+		assert.NoError(t, err)
+		publicKey, err := ParsePublicKeyPEM(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+		assert.NoError(t, err)
+
+		issuer := &JWT{
+			SigningAlgorithm: alg,
+			PrivateKey:       key,
+			Authenticate:     testAuthenticate,
+		}
+		verifier := &JWT{
+			SigningAlgorithm: alg,
+			PublicKey:        publicKey,
+		}
+		app := newJWTTestApp(issuer, verifier)
+
+		token := jwtLogin(t, app)
+
+		w := jwtRequest(app, "GET", "/auth", token)
+		assert.Equal(t, 200, w.Code, alg)
+		assert.Equal(t, "alice", w.Body.String(), alg)
+	}
+}
+
+func TestJWTVerifyOnlyRejectsOtherAlgorithms(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	hmacIssuer := &JWT{
+		Key:          []byte("secret"),
+		Authenticate: testAuthenticate,
+	}
+	verifier := &JWT{
+		SigningAlgorithm: "RS256",
+		PublicKey:        &rsaKey.PublicKey,
+	}
+	app := newJWTTestApp(hmacIssuer, verifier)
+
+	token := jwtLogin(t, app)
+
+	w := jwtRequest(app, "GET", "/auth", token)
+	assert.Equal(t, 401, w.Code)
+}
+
+func TestParsePrivateKeyPEM(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	ecDER, _ := x509.MarshalECPrivateKey(ecKey)
+	for _, block := range []*pem.Block{
+		{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)},
+		{Type: "EC PRIVATE KEY", Bytes: ecDER},
+	} {
+		key, err := ParsePrivateKeyPEM(pem.EncodeToMemory(block))
+		assert.NoError(t, err)
+		assert.NotNil(t, key)
+	}
+
+	_, err := ParsePrivateKeyPEM([]byte("garbage"))
+	assert.Error(t, err)
+}
+
+func TestJWTKeyRotation(t *testing.T) {
+	oldKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	newKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	before := &JWT{
+		SigningAlgorithm: "ES256",
+		Keys:             []*JWTKey{{ID: "k1", PrivateKey: oldKey}},
+		Authenticate:     testAuthenticate,
+	}
+	oldToken := jwtLogin(t, newJWTTestApp(before, before))
+
+	after := &JWT{
+		SigningAlgorithm: "ES256",
+		Keys: []*JWTKey{
+			{ID: "k1", PrivateKey: oldKey},
+			{ID: "k2", PrivateKey: newKey},
+		},
+		ActiveKeyID:  "k2",
+		Authenticate: testAuthenticate,
+	}
+	app := newJWTTestApp(after, after)
+	app.Get("/jwks", after.JWKSHandler())
+
+	newToken := jwtLogin(t, app)
+	assert.Equal(t, 200, jwtRequest(app, "GET", "/auth", oldToken).Code)
+	assert.Equal(t, 200, jwtRequest(app, "GET", "/auth", newToken).Code)
+
+	w := jwtRequest(app, "GET", "/jwks", "")
+	assert.Equal(t, 200, w.Code)
+	var set struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			Alg string `json:"alg"`
+			D   string `json:"d"`
+		} `json:"keys"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &set))
+	assert.Len(t, set.Keys, 2)
+	for _, key := range set.Keys {
+		assert.Equal(t, "EC", key.Kty)
+		assert.Equal(t, "ES256", key.Alg)
+		assert.Empty(t, key.D)
+	}
+
+	retired := &JWT{
+		SigningAlgorithm: "ES256",
+		Keys: []*JWTKey{
+			{ID: "k1", PrivateKey: oldKey, Expires: time.Now().Add(-time.Minute)},
+			{ID: "k2", PrivateKey: newKey},
+		},
+		ActiveKeyID: "k2",
+	}
+	app = newJWTTestApp(nil, retired)
+	assert.Equal(t, 401, jwtRequest(app, "GET", "/auth", oldToken).Code)
+	assert.Equal(t, 200, jwtRequest(app, "GET", "/auth", newToken).Code)
+}
+
+func TestJWTRemoteKeySet(t *testing.T) {
+	idpKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	idp := &JWT{
+		SigningAlgorithm: "RS256",
+		Keys:             []*JWTKey{{ID: "idp-1", PrivateKey: idpKey}},
+		IdentityKey:      "sub",
+		Authenticate:     testAuthenticate,
+	}
+
+	var server *httptest.Server
+	fetches := 0
+	idpApp := mel.New()
+	idpApp.Post("/login", idp.LoginHandler())
+	idpApp.Get("/.well-known/openid-configuration", func(c *mel.Context) {
+		c.JSON(200, mel.Map{"jwks_uri": server.URL + "/jwks"})
+	})
+	jwksHandler := idp.JWKSHandler()
+	idpApp.Get("/jwks", func(c *mel.Context) {
+		fetches++
+		jwksHandler(c)
+	})
+	server = httptest.NewServer(idpApp)
+	defer server.Close()
+
+	keySet := NewDiscoveryKeySet(server.URL + "/.well-known/openid-configuration")
+	keySet.MinRefreshInterval = time.Nanosecond
+	verifier := &JWT{
+		RemoteKeys:  keySet,
+		IdentityKey: "sub",
+	}
+	app := newJWTTestApp(nil, verifier)
+
+	token := jwtLogin(t, idpApp)
+	w := jwtRequest(app, "GET", "/auth", token)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "alice", w.Body.String())
+	assert.Equal(t, 1, fetches)
+
+	// Cached keys are used for known key IDs.
+	assert.Equal(t, 200, jwtRequest(app, "GET", "/auth", token).Code)
+	assert.Equal(t, 1, fetches)
+
+	// The identity provider rotates its key.
+	newKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	idp.Keys = append(idp.Keys, &JWTKey{ID: "idp-2", Algorithm: "ES256", PrivateKey: newKey})
+	idp.ActiveKeyID = "idp-2"
+	idp.init()
+
+	token = jwtLogin(t, idpApp)
+	assert.Equal(t, 200, jwtRequest(app, "GET", "/auth", token).Code)
+	assert.Equal(t, 2, fetches)
+
+	// Tokens signed by others are rejected.
+	forgedKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	other := &JWT{
+		SigningAlgorithm: "RS256",
+		Keys:             []*JWTKey{{ID: "idp-1", PrivateKey: forgedKey}},
+		IdentityKey:      "sub",
+		Authenticate:     testAuthenticate,
+	}
+	forged := jwtLogin(t, newJWTTestApp(other, other))
+	assert.Equal(t, 401, jwtRequest(app, "GET", "/auth", forged).Code)
+}
+
+func TestJWTRemoteKeySetRefresh(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	jwks, _ := json.Marshal(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+		{Key: key.Public(), KeyID: "idp-1", Algorithm: "RS256", Use: "sig"},
+	}})
+
+	var fetches int32
+	release := make(chan struct{})
+	var blocking int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		if atomic.LoadInt32(&blocking) == 1 {
+			<-release
+		}
+		w.Write(jwks)
+	}))
+	defer server.Close()
+
+	keySet := NewRemoteKeySet(server.URL)
+	keySet.MaxAge = time.Millisecond
+	keySet.MinRefreshInterval = time.Nanosecond
+
+	_, err := keySet.Key("idp-1")
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&fetches))
+
+	// Stale keys are served while the identity provider is slow.
+	atomic.StoreInt32(&blocking, 1)
+	time.Sleep(2 * time.Millisecond)
+	_, err = keySet.Key("idp-1")
+	assert.NoError(t, err)
+
+	// Lookups of unknown keys wait for the ongoing refresh instead of fetching again.
+	errs := make(chan error, 5)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			_, err := keySet.Key("idp-2")
+			errs <- err
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	for i := 0; i < cap(errs); i++ {
+		assert.Error(t, <-errs)
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&fetches))
+}
+
+func TestJWTRevocation(t *testing.T) {
+	j := &JWT{
+		Key:             []byte("secret"),
+		Authenticate:    testAuthenticate,
+		RevocationStore: cache.NewMemoryStore(time.Hour, time.Minute),
+	}
+	app := newJWTTestApp(j, j)
+	app.Post("/logout", j.Middleware(), func(c *mel.Context) {
+		assert.NoError(t, j.Revoke(c))
+		c.Status(204)
+	})
+
+	token := jwtLogin(t, app)
+	other := jwtLogin(t, app)
+	assert.NotEqual(t, token, other)
+
+	assert.Equal(t, 200, jwtRequest(app, "GET", "/auth", token).Code)
+	assert.Equal(t, 204, jwtRequest(app, "POST", "/logout", token).Code)
+	assert.Equal(t, 401, jwtRequest(app, "GET", "/auth", token).Code)
+	assert.Equal(t, 200, jwtRequest(app, "GET", "/auth", other).Code)
+
+	// An unavailable store doesn't make clients discard their tokens.
+	j.RevocationStore = failingStore{}
+	w := jwtRequest(app, "GET", "/auth", other)
+	assert.Equal(t, 503, w.Code)
+	assert.Empty(t, w.Header().Get("WWW-Authenticate"))
+}
+
+// failingStore is a cache.Store whose backend is unavailable.
+type failingStore struct{}
+
+func (failingStore) Get(key string, ptr interface{}) error {
+	return errors.New("store unavailable")
+}
+
+func (failingStore) Set(key string, value interface{}, expire time.Duration) error {
+	return errors.New("store unavailable")
+}
+
+func (failingStore) Delete(key string) error {
+	return errors.New("store unavailable")
+}
+
+func (failingStore) Clear() error {
+	return errors.New("store unavailable")
+}
+
+func jwtRefresh(app http.Handler, refreshToken string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("POST", "/refresh", strings.NewReader(url.Values{"refresh_token": {refreshToken}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, req)
+	return w
+}
+
+func TestJWTRefreshTokenRotation(t *testing.T) {
+	j := &JWT{
+		Key:          []byte("secret"),
+		Authenticate: testAuthenticate,
+		RefreshStore: cache.NewMemoryStore(time.Hour, time.Minute),
+	}
+	app := newJWTTestApp(j, j)
+	app.Post("/refresh", j.RefreshTokenHandler())
+
+	req, _ := http.NewRequest("POST", "/login", nil)
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, req)
+	var login struct {
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &login))
+	assert.NotEmpty(t, login.RefreshToken)
+
+	w = jwtRefresh(app, login.RefreshToken)
+	assert.Equal(t, 200, w.Code)
+	var refreshed struct {
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &refreshed))
+	assert.NotEqual(t, login.RefreshToken, refreshed.RefreshToken)
+	assert.Equal(t, 200, jwtRequest(app, "GET", "/auth", refreshed.Token).Code)
+
+	// Reusing the rotated token revokes the whole family.
+	assert.Equal(t, 401, jwtRefresh(app, login.RefreshToken).Code)
+	assert.Equal(t, 401, jwtRefresh(app, refreshed.RefreshToken).Code)
+
+	assert.Equal(t, 401, jwtRefresh(app, "unknown").Code)
+}
+
+// slowStore is a MemoryStore with slow reads to widen the window of races.
+type slowStore struct {
+	*cache.MemoryStore
+}
+
+func (s slowStore) Get(key string, ptr interface{}) error {
+	err := s.MemoryStore.Get(key, ptr)
+	time.Sleep(10 * time.Millisecond)
+	return err
+}
+
+func TestJWTRefreshTokenConcurrentReuse(t *testing.T) {
+	// plainStore hides the Add method of the underlying store.
+	type plainStore struct {
+		cache.Store
+	}
+
+	for _, store := range []cache.Store{
+		slowStore{cache.NewMemoryStore(time.Hour, time.Minute)},
+		plainStore{slowStore{cache.NewMemoryStore(time.Hour, time.Minute)}},
+	} {
+		j := &JWT{
+			Key:          []byte("secret"),
+			Authenticate: testAuthenticate,
+			RefreshStore: store,
+		}
+		app := newJWTTestApp(j, j)
+		app.Post("/refresh", j.RefreshTokenHandler())
+
+		req, _ := http.NewRequest("POST", "/login", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, req)
+		var login struct {
+			RefreshToken string `json:"refresh_token"`
+		}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &login))
+
+		// Only one of the concurrent uses rotates the token.
+		codes := make(chan int, 10)
+		for i := 0; i < cap(codes); i++ {
+			go func() {
+				codes <- jwtRefresh(app, login.RefreshToken).Code
+			}()
+		}
+		succeeded := 0
+		for i := 0; i < cap(codes); i++ {
+			if <-codes == 200 {
+				succeeded++
+			}
+		}
+		assert.Equal(t, 1, succeeded)
+	}
+}
+
+func TestJWTRefreshTokenCookie(t *testing.T) {
+	assert.Panics(t, func() {
+		(&JWT{
+			Key:          []byte("secret"),
+			Authenticate: testAuthenticate,
+			SendCookie:   true,
+			RefreshStore: cache.NewMemoryStore(time.Hour, time.Minute),
+		}).LoginHandler()
+	})
+
+	j := &JWT{
+		Key:               []byte("secret"),
+		Authenticate:      testAuthenticate,
+		SendCookie:        true,
+		RefreshStore:      cache.NewMemoryStore(time.Hour, time.Minute),
+		RefreshCookiePath: "/refresh",
+	}
+	app := newJWTTestApp(j, j)
+	app.Post("/refresh", j.RefreshTokenHandler())
+
+	refreshCookie := func(w *httptest.ResponseRecorder) *http.Cookie {
+		for _, cookie := range w.Result().Cookies() {
+			if cookie.Name == "refresh_token" {
+				return cookie
+			}
+		}
+		return nil
+	}
+	refresh := func(cookie *http.Cookie) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/refresh", nil)
+		req.AddCookie(&http.Cookie{Name: cookie.Name, Value: cookie.Value})
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, req)
+		return w
+	}
+
+	req, _ := http.NewRequest("POST", "/login", nil)
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	assert.NotContains(t, w.Body.String(), "refresh_token")
+	login := refreshCookie(w)
+	assert.NotNil(t, login)
+	assert.True(t, login.HttpOnly)
+	assert.Equal(t, "/refresh", login.Path)
+
+	w = refresh(login)
+	assert.Equal(t, 200, w.Code)
+	assert.NotContains(t, w.Body.String(), "refresh_token")
+	refreshed := refreshCookie(w)
+	assert.NotNil(t, refreshed)
+	assert.NotEqual(t, login.Value, refreshed.Value)
+
+	// Reusing the rotated token revokes the whole family.
+	assert.Equal(t, 401, refresh(login).Code)
+	assert.Equal(t, 401, refresh(refreshed).Code)
+}
+
+type testClaims struct {
+	Roles []string `json:"roles"`
+	jwt.StandardClaims
+}
+
+func TestJWTTypedClaims(t *testing.T) {
+	j := &JWT{
+		Key:          []byte("secret"),
+		Authenticate: testAuthenticate,
+		NewClaims: func() jwt.Claims {
+			return &testClaims{}
+		},
+		ClaimsFunc: func(userID string) jwt.Claims {
+			return &testClaims{Roles: []string{"admin"}, StandardClaims: jwt.StandardClaims{Subject: userID}}
+		},
+	}
+	app := mel.New()
+	app.Post("/login", j.LoginHandler())
+	app.Get("/auth", j.Middleware(), func(c *mel.Context) {
+		claims := j.ExtractTypedClaims(c).(*testClaims)
+		c.Text(200, claims.Subject+":"+strings.Join(claims.Roles, ","))
+	})
+
+	token := jwtLogin(t, app)
+	w := jwtRequest(app, "GET", "/auth", token)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "alice:admin", w.Body.String())
+
+	// Tokens whose claims don't fit the type are rejected instead of panicking.
+	malformed, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"id":    "alice",
+		"roles": "admin",
+	}).SignedString(j.Key)
+	assert.Equal(t, 401, jwtRequest(app, "GET", "/auth", malformed).Code)
+
+	noID, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"id": 42,
+	}).SignedString(j.Key)
+	assert.Equal(t, 401, jwtRequest(app, "GET", "/auth", noID).Code)
+}
+
+func TestJWTTypedClaimsMultipleAudience(t *testing.T) {
+	j := &JWT{
+		Key:          []byte("secret"),
+		Authenticate: testAuthenticate,
+		Audience:     []string{"a", "b"},
+		NewClaims: func() jwt.Claims {
+			return &testClaims{}
+		},
+	}
+	app := mel.New()
+	app.Post("/login", j.LoginHandler())
+	app.Get("/auth", j.Middleware(), func(c *mel.Context) {
+		c.Text(200, j.ExtractTypedClaims(c).(*testClaims).Audience)
+	})
+
+	w := jwtRequest(app, "GET", "/auth", jwtLogin(t, app))
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "a", w.Body.String())
+
+	// Claims types accepting an array keep all audiences.
+	j.NewClaims = func() jwt.Claims {
+		return &jwt.MapClaims{}
+	}
+	token, err := j.verifyToken(jwtLogin(t, app))
+	assert.NoError(t, err)
+	typed, err := j.decodeClaims(token)
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{"a", "b"}, (*typed.(*jwt.MapClaims))["aud"])
+}
+
+func TestJWTIssuerAudienceLeeway(t *testing.T) {
+	j := &JWT{
+		Key:          []byte("secret"),
+		Authenticate: testAuthenticate,
+		Issuer:       "https://auth.example.com",
+		Audience:     []string{"orders"},
+		Leeway:       time.Minute,
+	}
+	app := newJWTTestApp(j, j)
+	assert.Equal(t, 200, jwtRequest(app, "GET", "/auth", jwtLogin(t, app)).Code)
+
+	sign := func(claims jwt.MapClaims) string {
+		claims["id"] = "alice"
+		token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(j.Key)
+		return token
+	}
+	now := time.Now()
+
+	for _, test := range []struct {
+		claims jwt.MapClaims
+		err    error
+	}{
+		{jwt.MapClaims{"iss": "https://auth.example.com", "aud": []string{"billing", "orders"}}, nil},
+		{jwt.MapClaims{"iss": "https://evil.example.com", "aud": "orders"}, ErrInvalidIssuer},
+		{jwt.MapClaims{"iss": "https://auth.example.com", "aud": "billing"}, ErrInvalidAudience},
+		{jwt.MapClaims{"iss": "https://auth.example.com"}, ErrInvalidAudience},
+		{jwt.MapClaims{"iss": "https://auth.example.com", "aud": "orders", "exp": now.Add(-30 * time.Second).Unix()}, nil},
+		{jwt.MapClaims{"iss": "https://auth.example.com", "aud": "orders", "exp": now.Add(-2 * time.Minute).Unix()}, ErrTokenExpired},
+		{jwt.MapClaims{"iss": "https://auth.example.com", "aud": "orders", "nbf": now.Add(30 * time.Second).Unix()}, nil},
+		{jwt.MapClaims{"iss": "https://auth.example.com", "aud": "orders", "nbf": now.Add(2 * time.Minute).Unix()}, ErrTokenNotValidYet},
+		{jwt.MapClaims{"iss": "https://auth.example.com", "aud": "orders", "exp": "tomorrow"}, ErrMalformedClaims},
+	} {
+		_, err := j.verifyToken(sign(test.claims))
+		assert.Equal(t, test.err, err, "%v", test.claims)
+	}
+}
+
+func TestJWTTokenSources(t *testing.T) {
+	j := &JWT{
+		Key:          []byte("secret"),
+		Authenticate: testAuthenticate,
+		TokenBearer:  "header:Authorization, header:X-Auth-Token:Token, header:X-Api-Key:, cookie:jwt, query:token",
+	}
+	app := newJWTTestApp(j, j)
+	token := jwtLogin(t, app)
+
+	for _, header := range []http.Header{
+		{"Authorization": {"Bearer " + token}},
+		{"Authorization": {"bearer " + token}},
+		{"X-Auth-Token": {"Token " + token}},
+		{"X-Api-Key": {token}},
+		{"Cookie": {"jwt=" + token}},
+		{"Authorization": {"Basic dXNlcjpwYXNz"}, "Cookie": {"jwt=" + token}},
+	} {
+		req, _ := http.NewRequest("GET", "/auth", nil)
+		req.Header = header
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, req)
+		assert.Equal(t, 200, w.Code, "%v", header)
+	}
+
+	assert.Equal(t, 200, jwtRequest(app, "GET", "/auth?token="+token, "").Code)
+	assert.Equal(t, 401, jwtRequest(app, "GET", "/auth", "").Code)
+
+	for _, bearer := range []string{"header", "header:", "body:token", "query:token:x"} {
+		assert.Panics(t, func() {
+			parseTokenSources(bearer)
+		}, bearer)
+	}
+}
+
+func TestJWTCookieCSRF(t *testing.T) {
+	j := &JWT{
+		Key:          []byte("secret"),
+		Authenticate: testAuthenticate,
+		SendCookie:   true,
+	}
+	app := newJWTTestApp(j, j)
+	app.Post("/auth", j.Middleware(), func(c *mel.Context) {
+		c.Text(200, "posted")
+	})
+	app.Post("/logout", j.LogoutHandler())
+
+	req, _ := http.NewRequest("POST", "/login", nil)
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	assert.NotContains(t, w.Body.String(), `"token"`)
+
+	var tokenCookie, csrfCookie *http.Cookie
+	for _, cookie := range w.Result().Cookies() {
+		switch cookie.Name {
+		case "jwt":
+			tokenCookie = cookie
+		case "csrf_token":
+			csrfCookie = cookie
+		}
+	}
+	assert.NotNil(t, tokenCookie)
+	assert.NotNil(t, csrfCookie)
+	assert.True(t, tokenCookie.HttpOnly)
+	assert.True(t, tokenCookie.Secure)
+	assert.Equal(t, http.SameSiteLaxMode, tokenCookie.SameSite)
+	assert.False(t, csrfCookie.HttpOnly)
+
+	request := func(method, path, csrf string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, nil)
+		req.AddCookie(&http.Cookie{Name: tokenCookie.Name, Value: tokenCookie.Value})
+		req.AddCookie(&http.Cookie{Name: csrfCookie.Name, Value: csrfCookie.Value})
+		if csrf != "" {
+			req.Header.Set("X-CSRF-Token", csrf)
+		}
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, 200, request("GET", "/auth", "").Code)
+	assert.Equal(t, 403, request("POST", "/auth", "").Code)
+	assert.Equal(t, 403, request("POST", "/auth", "forged").Code)
+	assert.Equal(t, 200, request("POST", "/auth", csrfCookie.Value).Code)
+
+	w = request("POST", "/logout", csrfCookie.Value)
+	assert.Equal(t, 200, w.Code)
+	for _, cookie := range w.Result().Cookies() {
+		assert.True(t, cookie.MaxAge < 0, cookie.Name)
+	}
+}
+
+func TestJWTRequireScopesAndRoles(t *testing.T) {
+	j := &JWT{
+		Key:          []byte("secret"),
+		Authenticate: testAuthenticate,
+		Realm:        "api",
+		PayloadFunc: func(userID string) map[string]interface{} {
+			return map[string]interface{}{
+				"scope": "orders:read orders:write",
+				"roles": []string{"user"},
+			}
+		},
+	}
+	app := newJWTTestApp(j, j)
+	ok := func(c *mel.Context) {
+		c.Text(200, "ok")
+	}
+	app.Get("/orders", j.Middleware(), j.RequireScopes("orders:read", "orders:write"), ok)
+	app.Get("/billing", j.Middleware(), j.RequireScopes("orders:read", "billing:read"), ok)
+	app.Get("/users", j.Middleware(), j.RequireRoles("admin", "user"), ok)
+	app.Get("/admin", j.Middleware(), j.RequireRoles("admin"), ok)
+
+	token := jwtLogin(t, app)
+	assert.Equal(t, 200, jwtRequest(app, "GET", "/orders", token).Code)
+	assert.Equal(t, 200, jwtRequest(app, "GET", "/users", token).Code)
+
+	w := jwtRequest(app, "GET", "/billing", token)
+	assert.Equal(t, 403, w.Code)
+	assert.Equal(t, `Bearer realm="api", error="insufficient_scope", error_description="requires scope billing:read", scope="orders:read billing:read"`,
+		w.Header().Get("WWW-Authenticate"))
+
+	w = jwtRequest(app, "GET", "/admin", token)
+	assert.Equal(t, 403, w.Code)
+	assert.Contains(t, w.Header().Get("WWW-Authenticate"), `error="insufficient_scope"`)
+}
+
+func TestJWTErrors(t *testing.T) {
+	var lastErr error
+	j := &JWT{
+		Key:          []byte("secret"),
+		Authenticate: testAuthenticate,
+		Realm:        "api",
+		Unauthorized: func(c *mel.Context, code int, err error) {
+			lastErr = err
+			c.Text(code, err.Error())
+		},
+	}
+	app := newJWTTestApp(j, j)
+	token := jwtLogin(t, app)
+
+	expired, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"id":  "alice",
+		"exp": time.Now().Add(-time.Hour).Unix(),
+	}).SignedString(j.Key)
+
+	for _, test := range []struct {
+		header    string
+		code      int
+		err       error
+		challenge string
+	}{
+		{"", 401, ErrTokenMissing, `Bearer realm="api"`},
+		{"Basic dXNlcjpwYXNz", 400, ErrInvalidAuthHeader, `Bearer realm="api", error="invalid_request", error_description="invalid auth header"`},
+		{"Bearer " + expired, 401, ErrTokenExpired, `Bearer realm="api", error="invalid_token", error_description="token is expired"`},
+		{"Bearer " + token + "x", 401, ErrInvalidSignature, `Bearer realm="api", error="invalid_token", error_description="invalid token signature"`},
+		{"Bearer garbage", 401, ErrMalformedToken, `Bearer realm="api", error="invalid_token", error_description="malformed token"`},
+	} {
+		req, _ := http.NewRequest("GET", "/auth", nil)
+		if test.header != "" {
+			req.Header.Set("Authorization", test.header)
+		}
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, req)
+
+		assert.Equal(t, test.code, w.Code, test.header)
+		assert.Equal(t, test.challenge, w.Header().Get("WWW-Authenticate"))
+		assert.True(t, errors.Is(lastErr, test.err), "%v", lastErr)
+
+		var te *TokenError
+		assert.True(t, errors.As(lastErr, &te))
+	}
+}
+
+func TestJWTIntrospection(t *testing.T) {
+	j := &JWT{
+		Key:                  []byte("secret"),
+		Authenticate:         testAuthenticate,
+		RevocationStore:      cache.NewMemoryStore(time.Hour, time.Minute),
+		IntrospectionClients: map[string]string{"legacy": "s3cret"},
+		PayloadFunc: func(userID string) map[string]interface{} {
+			return map[string]interface{}{"scope": "orders:read"}
+		},
+	}
+	app := newJWTTestApp(j, j)
+	app.Post("/introspect", j.IntrospectionHandler())
+	token := jwtLogin(t, app)
+
+	introspect := func(token, user, password string) (int, map[string]interface{}) {
+		req, _ := http.NewRequest("POST", "/introspect", strings.NewReader(url.Values{"token": {token}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(user, password)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, req)
+
+		var resp map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp
+	}
+
+	code, resp := introspect(token, "legacy", "s3cret")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, true, resp["active"])
+	assert.Equal(t, "alice", resp["sub"])
+	assert.Equal(t, "orders:read", resp["scope"])
+	assert.NotNil(t, resp["exp"])
+
+	code, _ = introspect(token, "legacy", "wrong")
+	assert.Equal(t, 401, code)
+
+	code, resp = introspect(token+"x", "legacy", "s3cret")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, map[string]interface{}{"active": false}, resp)
+
+	parsed, _ := j.verifyToken(token)
+	assert.NoError(t, j.revokeClaims(parsed.Claims.(jwt.MapClaims)))
+	_, resp = introspect(token, "legacy", "s3cret")
+	assert.Equal(t, false, resp["active"])
+
+	j.RevocationStore = failingStore{}
+	code, _ = introspect(jwtLogin(t, app), "legacy", "s3cret")
+	assert.Equal(t, 503, code)
+}
+
+func TestJWTTokenVersion(t *testing.T) {
+	versions := map[string]int{"alice": 1}
+	calls := 0
+	j := &JWT{
+		Key:          []byte("secret"),
+		Authenticate: testAuthenticate,
+		TokenVersion: func(userID string) (int, error) {
+			calls++
+			return versions[userID], nil
+		},
+		TokenVersionStore: cache.NewMemoryStore(time.Hour, time.Minute),
+	}
+	app := newJWTTestApp(j, j)
+
+	token := jwtLogin(t, app)
+	assert.Equal(t, 200, jwtRequest(app, "GET", "/auth", token).Code)
+	assert.Equal(t, 200, jwtRequest(app, "GET", "/auth", token).Code)
+	assert.Equal(t, 1, calls)
+
+	// Password change logs out all devices.
+	versions["alice"]++
+	assert.NoError(t, j.InvalidateTokenVersion("alice"))
+	w := jwtRequest(app, "GET", "/auth", token)
+	assert.Equal(t, 401, w.Code)
+	assert.Contains(t, w.Body.String(), ErrStaleTokenVersion.Error())
+
+	assert.Equal(t, 200, jwtRequest(app, "GET", "/auth", jwtLogin(t, app)).Code)
+
+	// An unavailable backend doesn't make clients discard their tokens.
+	token = jwtLogin(t, app)
+	j.TokenVersionStore = failingStore{}
+	j.TokenVersion = func(userID string) (int, error) {
+		return 0, errors.New("database unavailable")
+	}
+	w = jwtRequest(app, "GET", "/auth", token)
+	assert.Equal(t, 503, w.Code)
+	assert.Empty(t, w.Header().Get("WWW-Authenticate"))
+}
+
+func TestJWTRefreshHandler(t *testing.T) {
+	j := &JWT{
+		Key:          []byte("secret"),
+		Authenticate: testAuthenticate,
+		MaxRefresh:   24 * time.Hour,
+	}
+	app := newJWTTestApp(j, j)
+	app.Post("/refresh", j.RefreshHandler)
+
+	sign := func(exp, origIat time.Time) string {
+		token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+			"id":       "alice",
+			"exp":      exp.Unix(),
+			"orig_iat": origIat.Unix(),
+		}).SignedString(j.Key)
+		return token
+	}
+	now := time.Now()
+
+	w := jwtRequest(app, "POST", "/refresh", sign(now.Add(-time.Minute), now.Add(-time.Hour)))
+	assert.Equal(t, 200, w.Code)
+	var resp struct {
+		Token string `json:"token"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, 200, jwtRequest(app, "GET", "/auth", resp.Token).Code)
+
+	refreshed, err := j.verifyToken(resp.Token)
+	assert.NoError(t, err)
+	assert.Equal(t, float64(now.Add(-time.Hour).Unix()), refreshed.Claims.(jwt.MapClaims)["orig_iat"])
+
+	w = jwtRequest(app, "POST", "/refresh", sign(now.Add(-time.Minute), now.Add(-25*time.Hour)))
+	assert.Equal(t, 401, w.Code)
+	assert.Contains(t, w.Body.String(), ErrRefreshExpired.Error())
+
+	assert.Equal(t, 401, jwtRequest(app, "POST", "/refresh", "").Code)
+	assert.Equal(t, 401, jwtRequest(app, "POST", "/refresh", "garbage").Code)
+
+	j.MaxRefresh = 0
+	assert.Equal(t, 401, jwtRequest(app, "POST", "/refresh", sign(now.Add(time.Minute), now)).Code)
+}
+
+func TestJWTEncryption(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	secret := []byte("0123456789abcdef0123456789abcdef")
+
+	for _, c := range []struct {
+		encrypt, decrypt interface{}
+	}{
+		{secret, nil},
+		{&rsaKey.PublicKey, rsaKey},
+	} {
+		issuer := &JWT{
+			Key:           []byte("secret"),
+			Authenticate:  testAuthenticate,
+			EncryptionKey: c.encrypt,
+			PayloadFunc: func(userID string) map[string]interface{} {
+				return map[string]interface{}{"account": "internal-42"}
+			},
+		}
+		verifier := &JWT{
+			Key:           []byte("secret"),
+			DecryptionKey: c.decrypt,
+		}
+		if c.decrypt == nil {
+			verifier.DecryptionKey = secret
+		}
+		app := newJWTTestApp(issuer, verifier)
+
+		token := jwtLogin(t, app)
+		assert.Equal(t, 5, len(strings.Split(token, ".")))
+		assert.NotContains(t, token, jwt.EncodeSegment([]byte(`"internal-42"`)))
+
+		w := jwtRequest(app, "GET", "/auth", token)
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "alice", w.Body.String())
+
+		parsed, err := verifier.verifyToken(token)
+		assert.NoError(t, err)
+		assert.Equal(t, "internal-42", parsed.Claims.(jwt.MapClaims)["account"])
+
+		// Tampered authentication tag.
+		parts := strings.Split(token, ".")
+		if parts[4][0] == 'A' {
+			parts[4] = "B" + parts[4][1:]
+		} else {
+			parts[4] = "A" + parts[4][1:]
+		}
+		assert.Equal(t, 401, jwtRequest(app, "GET", "/auth", strings.Join(parts, ".")).Code)
+	}
+
+	// Encrypted tokens are rejected without the decryption key.
+	issuer := &JWT{
+		Key:           []byte("secret"),
+		Authenticate:  testAuthenticate,
+		EncryptionKey: secret,
+	}
+	app := newJWTTestApp(issuer, &JWT{Key: []byte("secret")})
+	w := jwtRequest(app, "GET", "/auth", jwtLogin(t, app))
+	assert.Equal(t, 401, w.Code)
+	assert.Contains(t, w.Body.String(), ErrDecryptToken.Error())
+
+	assert.Panics(t, func() {
+		(&JWT{Key: []byte("secret"), EncryptionKey: []byte("short")}).init()
+	})
+}
+
+func newDPoPProof(t *testing.T, key *ecdsa.PrivateKey, method, htu, token string) string {
+	options := (&jose.SignerOptions{EmbedJWK: true}).WithType("dpop+jwt")
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: key}, options)
+	assert.NoError(t, err)
+
+	claims := map[string]interface{}{
+		"jti": newTokenID(),
+		"htm": method,
+		"htu": htu,
+		"iat": time.Now().Unix(),
+	}
+	if token != "" {
+		sum := sha256.Sum256([]byte(token))
+		claims["ath"] = base64.RawURLEncoding.EncodeToString(sum[:])
+	}
+	payload, _ := json.Marshal(claims)
+
+	object, err := signer.Sign(payload)
+	assert.NoError(t, err)
+	proof, err := object.CompactSerialize()
+	assert.NoError(t, err)
+	return proof
+}
+
+func TestJWTDPoP(t *testing.T) {
+	j := &JWT{
+		Key:          []byte("secret"),
+		Authenticate: testAuthenticate,
+		DPoP:         true,
+		DPoPStore:    cache.NewMemoryStore(time.Minute, time.Minute),
+	}
+	app := newJWTTestApp(j, j)
+	clientKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	dpopRequest := func(method, path, token, proof string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, nil)
+		req.Host = "example.com"
+		if token != "" {
+			req.Header.Set("Authorization", "DPoP "+token)
+		}
+		if proof != "" {
+			req.Header.Set("DPoP", proof)
+		}
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, req)
+		return w
+	}
+
+	// Login with a proof binds the token to the client key.
+	w := dpopRequest("POST", "/login", "", newDPoPProof(t, clientKey, "POST", "http://example.com/login", ""))
+	assert.Equal(t, 200, w.Code)
+	var resp struct {
+		Token string `json:"token"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	token := resp.Token
+
+	parsed, err := j.verifyToken(token)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, tokenKeyThumbprint(parsed.Claims.(jwt.MapClaims)))
+
+	proof := newDPoPProof(t, clientKey, "GET", "http://example.com/auth", token)
+	w = dpopRequest("GET", "/auth", token, proof)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "alice", w.Body.String())
+
+	// Replayed proof.
+	w = dpopRequest("GET", "/auth", token, proof)
+	assert.Equal(t, 401, w.Code)
+	assert.Contains(t, w.Header().Get("WWW-Authenticate"), `DPoP realm=""`)
+	assert.Contains(t, w.Header().Get("WWW-Authenticate"), `error="invalid_dpop_proof"`)
+
+	// Missing proof, or presented as a bearer token.
+	assert.Equal(t, 401, dpopRequest("GET", "/auth", token, "").Code)
+	assert.Equal(t, 401, jwtRequest(app, "GET", "/auth", token).Code)
+
+	// Proofs of another key, method, URL or token.
+	for _, proof := range []string{
+		newDPoPProof(t, otherKey, "GET", "http://example.com/auth", token),
+		newDPoPProof(t, clientKey, "POST", "http://example.com/auth", token),
+		newDPoPProof(t, clientKey, "GET", "http://example.com/other", token),
+		newDPoPProof(t, clientKey, "GET", "http://example.com/auth", token+"x"),
+		newDPoPProof(t, clientKey, "GET", "http://example.com/auth", ""),
+	} {
+		assert.Equal(t, 401, dpopRequest("GET", "/auth", token, proof).Code)
+	}
+
+	// Unbound tokens are still accepted as bearer tokens.
+	w = jwtRequest(app, "GET", "/auth", jwtLogin(t, app))
+	assert.Equal(t, 200, w.Code)
+
+	assert.Panics(t, func() {
+		(&JWT{Key: []byte("secret"), DPoP: true}).init()
+	})
+}
+
+func TestJWTDPoPConcurrentReplay(t *testing.T) {
+	// plainStore hides the Add method of the underlying store.
+	type plainStore struct {
+		cache.Store
+	}
+
+	clientKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	for _, store := range []cache.Store{
+		slowStore{cache.NewMemoryStore(time.Minute, time.Minute)},
+		plainStore{slowStore{cache.NewMemoryStore(time.Minute, time.Minute)}},
+	} {
+		j := &JWT{
+			Key:          []byte("secret"),
+			Authenticate: testAuthenticate,
+			DPoP:         true,
+			DPoPStore:    store,
+		}
+		app := newJWTTestApp(j, j)
+
+		// Only one of the concurrent uses of a proof is accepted.
+		proof := newDPoPProof(t, clientKey, "POST", "http://example.com/login", "")
+		codes := make(chan int, 10)
+		for i := 0; i < cap(codes); i++ {
+			go func() {
+				req, _ := http.NewRequest("POST", "/login", nil)
+				req.Host = "example.com"
+				req.Header.Set("DPoP", proof)
+				w := httptest.NewRecorder()
+				app.ServeHTTP(w, req)
+				codes <- w.Code
+			}()
+		}
+		succeeded := 0
+		for i := 0; i < cap(codes); i++ {
+			if <-codes == 200 {
+				succeeded++
+			}
+		}
+		assert.Equal(t, 1, succeeded)
+	}
+}
@@ -0,0 +1,74 @@
+package melware
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/ridewindx/melware/cache"
+)
+
+// ErrStaleTokenVersion is the error of tokens issued before the token version of the user changed.
+var ErrStaleTokenVersion = errors.New("token version is stale")
+
+// Key prefix for caching token versions into TokenVersionStore.
+const tokenVersionPrefix = "jwt_version:"
+
+// currentTokenVersion returns the current token version of the user,
+// from TokenVersionStore if cached.
+func (j *JWT) currentTokenVersion(userID string) (int, error) {
+	var version int
+
+	if j.TokenVersionStore != nil {
+		err := j.TokenVersionStore.Get(tokenVersionPrefix+userID, &version)
+		if err == nil {
+			return version, nil
+		}
+		if err != cache.ErrCacheMiss {
+			return 0, err
+		}
+	}
+
+	version, err := j.TokenVersion(userID)
+	if err != nil {
+		return 0, err
+	}
+
+	if j.TokenVersionStore != nil {
+		j.TokenVersionStore.Set(tokenVersionPrefix+userID, version, j.TokenVersionTimeout)
+	}
+	return version, nil
+}
+
+// checkTokenVersion checks the "ver" claim against the current token version of the user.
+func (j *JWT) checkTokenVersion(userID string, claims jwt.MapClaims) error {
+	if j.TokenVersion == nil {
+		return nil
+	}
+
+	ver, ok := claims["ver"].(float64)
+	if !ok {
+		// Tokens issued before versioning was enabled are stale as well.
+		return ErrStaleTokenVersion
+	}
+
+	version, err := j.currentTokenVersion(userID)
+	if err != nil {
+		return fmt.Errorf("check token version failed: %w", ErrBackendUnavailable)
+	}
+
+	if int(ver) != version {
+		return ErrStaleTokenVersion
+	}
+	return nil
+}
+
+// InvalidateTokenVersion removes the cached token version of the user.
+// Call it after increasing the token version of the user, e.g., on password change,
+// so that the tokens of the user are rejected at once instead of after TokenVersionTimeout.
+func (j *JWT) InvalidateTokenVersion(userID string) error {
+	if j.TokenVersionStore == nil {
+		return nil
+	}
+	return j.TokenVersionStore.Delete(tokenVersionPrefix + userID)
+}
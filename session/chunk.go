@@ -0,0 +1,86 @@
+package session
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Maximum length of a cookie value, leaving room for the name and attributes
+	// within the 4096 bytes browsers allow for a cookie.
+	cookieChunkSize = 3800
+
+	// Maximum number of chunks of a cookie.
+	maxCookieChunks = 10
+)
+
+// chunkName returns the cookie name of the i-th chunk.
+func chunkName(name string, i int) string {
+	return name + "." + strconv.Itoa(i)
+}
+
+// readChunkedCookie reads the cookie value, which is either in the cookie of the name,
+// or split into the cookies "name.0", "name.1", ...
+func readChunkedCookie(r *http.Request, name string) (string, error) {
+	if cookie, err := r.Cookie(name); err == nil {
+		return cookie.Value, nil
+	}
+
+	var chunks []string
+	for i := 0; i < maxCookieChunks; i++ {
+		cookie, err := r.Cookie(chunkName(name, i))
+		if err != nil {
+			break
+		}
+		chunks = append(chunks, cookie.Value)
+	}
+
+	if len(chunks) == 0 {
+		return "", http.ErrNoCookie
+	}
+	return strings.Join(chunks, ""), nil
+}
+
+// writeChunkedCookie sets the cookie value, which is split into chunks if too long,
+// and deletes the cookies of the request which are no longer used, e.g.,
+// the stale chunks after the value has shrunk.
+func writeChunkedCookie(r *http.Request, w http.ResponseWriter, name, value string, options *Options) {
+	used := make(map[string]bool)
+
+	if len(value) <= cookieChunkSize {
+		http.SetCookie(w, newCookie(name, value, options))
+		used[name] = true
+	} else {
+		for i := 0; len(value) > 0; i++ {
+			n := cookieChunkSize
+			if n > len(value) {
+				n = len(value)
+			}
+			http.SetCookie(w, newCookie(chunkName(name, i), value[:n], options))
+			used[chunkName(name, i)] = true
+			value = value[n:]
+		}
+	}
+
+	expired := *options
+	expired.MaxAge = -1
+
+	for _, cookie := range r.Cookies() {
+		if used[cookie.Name] {
+			continue
+		}
+		if cookie.Name == name || isChunkOf(cookie.Name, name) {
+			http.SetCookie(w, newCookie(cookie.Name, "", &expired))
+		}
+	}
+}
+
+// isChunkOf reports whether the cookie name is a chunk of the cookie.
+func isChunkOf(cookieName, name string) bool {
+	if !strings.HasPrefix(cookieName, name+".") {
+		return false
+	}
+	_, err := strconv.Atoi(cookieName[len(name)+1:])
+	return err == nil
+}
@@ -2,6 +2,7 @@ package session
 
 import (
 	"net/http"
+	"time"
 	"github.com/gorilla/securecookie"
 	"fmt"
 )
@@ -37,6 +38,13 @@ func NewCookieStore(keyPairs ...[]byte) *CookieStore {
 	}
 
 	cs.MaxAge(cs.Options.MaxAge)
+
+	// Large sessions are split into chunks instead.
+	for _, codec := range cs.Codecs {
+		if c, ok := codec.(*securecookie.SecureCookie); ok {
+			c.MaxLength(cookieChunkSize * maxCookieChunks)
+		}
+	}
 	return cs
 }
 
@@ -50,28 +58,54 @@ func NewCookieStore(keyPairs ...[]byte) *CookieStore {
 func (store *CookieStore) Get(r *http.Request, name string, s *session) error {
 	// Copy options.
 	options := *store.Options
-	s.Options = &options
+	s.options = &options
 
-	cookie, err := r.Cookie(name)
+	value, err := readChunkedCookie(r, name)
 	if err != nil {
 		return err
 	}
 	// Decode to get contents.
-	err = securecookie.DecodeMulti(name, cookie.Value, &s.Contents, store.Codecs...)
-	return err
+	rotated, err := decodeCookie(name, value, &s.Contents, store.Codecs...)
+	if err != nil {
+		return err
+	}
+	// Re-encode with the current key on save.
+	s.changed = rotated
+
+	if s.options.lifetimeExceeded(s.Contents) || s.options.idleExceeded(s.Contents) {
+		// Start over with a new session.
+		s.Contents = make(Contents)
+		return nil
+	}
+
+	if s.options.IdleTimeout > 0 {
+		// Re-issue the cookie to extend the idle timeout.
+		s.Contents[accessedAtKey] = time.Now().Unix()
+		s.changed = true
+	}
+	return nil
 }
 
 // Save adds a single session to the response.
 func (store *CookieStore) Save(r *http.Request, w http.ResponseWriter, s *session) error {
+	s.options.stamp(s.Contents)
+
 	// Encode to put contents.
-	value, err := securecookie.EncodeMulti(s.Name, s.Contents, store.Codecs...)
+	value, err := securecookie.EncodeMulti(s.name, s.Contents, store.Codecs...)
 	if err != nil {
 		return err
 	}
-	http.SetCookie(w, newCookie(s.Name, value, s.Options))
+	writeChunkedCookie(r, w, s.name, value, s.options)
 	return nil
 }
 
+// Regenerate re-issues the session cookie with the current contents.
+// Cookie sessions have no server-side state, so the old cookie can't be invalidated
+// and stays valid until it expires. Use a server-side store where session fixation matters.
+func (store *CookieStore) Regenerate(r *http.Request, w http.ResponseWriter, s *session) error {
+	return store.Save(r, w, s)
+}
+
 // MaxAge sets the maximum age for cookie.
 // Individual sessions can be deleted by setting Options.MaxAge
 // = -1 for that session.
@@ -0,0 +1,215 @@
+package session
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// MemoryStore stores sessions in memory, which is useful for development and tests.
+// Sessions are lost when the process exits, and are not shared between processes.
+type MemoryStore struct {
+	*Options // default configuration
+
+	DefaultMaxAge int // default TTL for a MaxAge == 0 session
+
+	mu       sync.RWMutex
+	sessions map[string]memorySession
+
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+type memorySession struct {
+	contents Contents
+	expires  time.Time
+}
+
+// NewMemoryStore returns a new MemoryStore.
+// A janitor goroutine deletes expired sessions every cleanupInterval,
+// until the store is closed. If cleanupInterval <= 0, expired sessions
+// are only deleted when they are accessed.
+func NewMemoryStore(cleanupInterval time.Duration) *MemoryStore {
+	ms := &MemoryStore{
+		Options: &Options{
+			Path:   "/",
+			MaxAge: sessionExpire,
+		},
+		DefaultMaxAge: 60 * 20,
+		sessions:      make(map[string]memorySession),
+		stop:          make(chan struct{}),
+	}
+
+	if cleanupInterval > 0 {
+		go ms.janitor(cleanupInterval)
+	}
+	return ms
+}
+
+func (store *MemoryStore) janitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			store.DeleteExpired()
+		case <-store.stop:
+			return
+		}
+	}
+}
+
+// Close stops the janitor goroutine.
+func (store *MemoryStore) Close() error {
+	store.closeOnce.Do(func() {
+		close(store.stop)
+	})
+	return nil
+}
+
+func (store *MemoryStore) Get(r *http.Request, name string, s *session) error {
+	// Copy options.
+	options := *store.Options
+	s.options = &options
+
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return err
+	}
+
+	contents, ok := store.Contents(cookie.Value)
+	if !ok {
+		return nil
+	}
+
+	if s.options.lifetimeExceeded(contents) || s.options.idleExceeded(contents) {
+		// Destroy the session and start over with a new one.
+		store.Delete(cookie.Value)
+		return nil
+	}
+
+	s.id = cookie.Value
+	s.Contents = contents
+
+	if s.options.IdleTimeout > 0 {
+		// Save again to extend the idle timeout.
+		s.Contents[accessedAtKey] = time.Now().Unix()
+		s.changed = true
+	}
+	return nil
+}
+
+func (store *MemoryStore) Save(r *http.Request, w http.ResponseWriter, s *session) error {
+	s.options.stamp(s.Contents)
+	age := s.options.expiry(s.Contents, store.DefaultMaxAge)
+
+	// A session past MaxLifetime is deleted as if MaxAge were negative.
+	if s.options.MaxAge < 0 || age == 0 {
+		store.Delete(s.id)
+
+		expired := *s.options
+		expired.MaxAge = -1
+		http.SetCookie(w, newCookie(s.name, "", &expired))
+		return nil
+	}
+
+	if s.id == "" {
+		s.id = generateID()
+	}
+
+	store.mu.Lock()
+	store.sessions[s.id] = memorySession{
+		contents: copyContents(s.Contents),
+		expires:  time.Now().Add(time.Duration(age) * time.Second),
+	}
+	store.mu.Unlock()
+
+	http.SetCookie(w, newCookie(s.name, s.id, s.options))
+	return nil
+}
+
+// Regenerate saves the session contents under a new ID, and deletes the old ID.
+func (store *MemoryStore) Regenerate(r *http.Request, w http.ResponseWriter, s *session) error {
+	oldID := s.id
+	s.id = generateID()
+
+	if err := store.Save(r, w, s); err != nil {
+		s.id = oldID
+		return err
+	}
+
+	store.mu.Lock()
+	delete(store.sessions, oldID)
+	store.mu.Unlock()
+	return nil
+}
+
+// Contents returns a copy of the contents of the unexpired session with the ID.
+func (store *MemoryStore) Contents(id string) (Contents, bool) {
+	store.mu.RLock()
+	ms, ok := store.sessions[id]
+	store.mu.RUnlock()
+
+	if !ok || time.Now().After(ms.expires) {
+		return nil, false
+	}
+	return copyContents(ms.contents), true
+}
+
+// IDs returns the IDs of all unexpired sessions.
+func (store *MemoryStore) IDs() []string {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	now := time.Now()
+	ids := make([]string, 0, len(store.sessions))
+	for id, ms := range store.sessions {
+		if now.Before(ms.expires) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// Len returns the number of unexpired sessions.
+func (store *MemoryStore) Len() int {
+	return len(store.IDs())
+}
+
+// Delete deletes the session with the ID.
+func (store *MemoryStore) Delete(id string) {
+	store.mu.Lock()
+	delete(store.sessions, id)
+	store.mu.Unlock()
+}
+
+// Clear deletes all sessions.
+func (store *MemoryStore) Clear() {
+	store.mu.Lock()
+	store.sessions = make(map[string]memorySession)
+	store.mu.Unlock()
+}
+
+// DeleteExpired deletes all expired sessions.
+func (store *MemoryStore) DeleteExpired() {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	now := time.Now()
+	for id, ms := range store.sessions {
+		if now.After(ms.expires) {
+			delete(store.sessions, id)
+		}
+	}
+}
+
+// copyContents returns a shallow copy of the contents,
+// so that stored sessions are not changed by requests in flight.
+func copyContents(contents Contents) Contents {
+	c := make(Contents, len(contents))
+	for k, v := range contents {
+		c[k] = v
+	}
+	return c
+}
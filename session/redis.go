@@ -168,7 +168,7 @@ func (s *RedisStore) ping() (bool, error) {
 func (store *RedisStore) Get(r *http.Request, name string, s *session) error {
 	// Copy options.
 	options := *store.Options
-	s.Options = &options
+	s.options = &options
 
 	cookie, err := r.Cookie(name)
 	if err != nil {
@@ -176,7 +176,7 @@ func (store *RedisStore) Get(r *http.Request, name string, s *session) error {
 	}
 
 	// Decode to get ID.
-	err = securecookie.DecodeMulti(name, cookie.Value, &s.ID, store.Codecs...)
+	rotated, err := decodeCookie(name, cookie.Value, &s.id, store.Codecs...)
 	if err != nil {
 		return err
 	}
@@ -184,7 +184,7 @@ func (store *RedisStore) Get(r *http.Request, name string, s *session) error {
 	conn := store.Pool.Get()
 	defer conn.Close()
 
-	data, err := conn.Do("GET", store.keyPrefix+s.ID)
+	data, err := conn.Do("GET", store.keyPrefix+s.id)
 	if data == nil { // no data was associated with the key
 		return nil
 	}
@@ -194,24 +194,60 @@ func (store *RedisStore) Get(r *http.Request, name string, s *session) error {
 	}
 	// Deserialize to get contents.
 	err = store.serializer.Deserialize(b, &s.Contents)
-	return err
+	if err != nil {
+		return err
+	}
+	// Re-encode the ID with the current key on save.
+	s.changed = rotated
+
+	// The idle timeout is enforced by the TTL of the key.
+	age := s.options.expiry(s.Contents, store.DefaultMaxAge)
+	if age == 0 {
+		// Destroy the session and start over with a new one.
+		err = store.delete(conn, s.id)
+		s.id = ""
+		s.Contents = make(Contents)
+		return err
+	}
+
+	if _, ok := s.options.timeoutTTL(s.Contents); ok {
+		// Slide the idle timeout.
+		_, err = conn.Do("EXPIRE", store.keyPrefix+s.id, age)
+		if err != nil {
+			return err
+		}
+	}
+
+	if userID := s.UserID(); userID != "" {
+		// Update the last seen time of the user session.
+		age, err := redis.Int(conn.Do("TTL", store.keyPrefix+s.id))
+		if err != nil {
+			return err
+		}
+		if age > 0 {
+			return store.indexSession(conn, r, s, userID, age)
+		}
+	}
+	return nil
 }
 
 func (store *RedisStore) Save(r *http.Request, w http.ResponseWriter, s *session) error {
-	if s.Options.MaxAge < 0 {
+	s.options.stamp(s.Contents)
+
+	// A session past MaxLifetime is deleted as if MaxAge were negative.
+	if s.options.MaxAge < 0 || s.options.expiry(s.Contents, store.DefaultMaxAge) == 0 {
 		conn := store.Pool.Get()
 		defer conn.Close()
 		// Delete ID from Redis.
-		if _, err := conn.Do("DEL", store.keyPrefix+ s.ID); err != nil {
+		if err := store.delete(conn, s.id); err != nil {
 			return err
 		}
-		http.SetCookie(w, newCookie(s.Name, "", s.Options))
+		expired := *s.options
+		expired.MaxAge = -1
+		http.SetCookie(w, newCookie(s.name, "", &expired))
 	} else {
-		if s.ID == "" {
-			// Generate ID.
-			id := securecookie.GenerateRandomKey(32)
-			id = base32.StdEncoding.EncodeToString(id)
-			s.ID = strings.TrimRight(id, "=")
+		if s.id == "" {
+			s.id = generateID()
 		}
 
 		// Serialize to put contents.
@@ -226,31 +262,73 @@ func (store *RedisStore) Save(r *http.Request, w http.ResponseWriter, s *session
 		conn := store.Pool.Get()
 		defer conn.Close()
 
-		age := s.Options.MaxAge
-		if age == 0 {
-			age = store.DefaultMaxAge
-		}
+		age := s.options.expiry(s.Contents, store.DefaultMaxAge)
 
 		// Store ID and contents to Redis.
-		_, err = conn.Do("SETEX", store.keyPrefix+s.ID, age, b)
+		_, err = conn.Do("SETEX", store.keyPrefix+s.id, age, b)
+		if err != nil {
+			return err
+		}
+
+		if userID := s.UserID(); userID != "" {
+			err = store.indexSession(conn, r, s, userID, age)
+		} else {
+			// The user ID may have been cleared.
+			err = store.unindexSession(conn, s.id)
+		}
 		if err != nil {
 			return err
 		}
 
 		// Encode to put ID.
-		value, err := securecookie.EncodeMulti(s.Name, s.ID, store.Codecs...)
+		value, err := securecookie.EncodeMulti(s.name, s.id, store.Codecs...)
 		if err != nil {
 			return err
 		}
-		http.SetCookie(w, newCookie(s.Name, value, s.Options))
+		http.SetCookie(w, newCookie(s.name, value, s.options))
 	}
 	return nil
 }
 
+// Regenerate saves the session contents under a new ID,
+// and deletes the old ID from Redis.
+func (store *RedisStore) Regenerate(r *http.Request, w http.ResponseWriter, s *session) error {
+	oldID := s.id
+	s.id = generateID()
+
+	if err := store.Save(r, w, s); err != nil {
+		s.id = oldID
+		return err
+	}
+
+	if oldID == "" {
+		return nil
+	}
+
+	conn := store.Pool.Get()
+	defer conn.Close()
+	// Delete old ID from Redis.
+	return store.delete(conn, oldID)
+}
+
+// delete deletes the session from Redis and the index of its user.
+func (store *RedisStore) delete(conn redis.Conn, id string) error {
+	if _, err := conn.Do("DEL", store.keyPrefix+id); err != nil {
+		return err
+	}
+	return store.unindexSession(conn, id)
+}
+
+// generateID generates a random session ID.
+func generateID() string {
+	id := base32.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(32))
+	return strings.TrimRight(id, "=")
+}
+
 // SessionSerializer provides an interface hook for alternative serializers
 type SessionSerializer interface {
-	Deserialize(d []byte, sv Contents) error
-	Serialize(sv *Contents) ([]byte, error)
+	Deserialize(d []byte, sv *Contents) error
+	Serialize(sv Contents) ([]byte, error)
 }
 
 // JSONSerializer encode the session map to JSON.
@@ -280,7 +358,7 @@ func (s JSONSerializer) Deserialize(d []byte, sv *Contents) error {
 		return err
 	}
 	for k, v := range m {
-		sv[k] = v
+		(*sv)[k] = v
 	}
 	return nil
 }
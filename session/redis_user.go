@@ -0,0 +1,174 @@
+package session
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// ErrSessionNotFound is returned when revoking a session which doesn't exist
+// or doesn't belong to the user.
+var ErrSessionNotFound = errors.New("session not found")
+
+// SessionInfo is the metadata of a session associated with a user.
+type SessionInfo struct {
+	ID        string
+	UserID    string
+	UserAgent string
+	IP        string
+	CreatedAt time.Time
+	LastSeen  time.Time
+}
+
+// userSessionsKey returns the key of the sorted set of the session IDs of the user,
+// scored by their expiration time.
+func (store *RedisStore) userSessionsKey(userID string) string {
+	return store.keyPrefix + "user:" + userID
+}
+
+// sessionInfoKey returns the key of the hash of the session metadata.
+func (store *RedisStore) sessionInfoKey(id string) string {
+	return store.keyPrefix + "meta:" + id
+}
+
+// indexSession adds the session to the index of its user, and updates its metadata.
+// The session is removed from the index of the user it was previously associated with.
+// age is the TTL of the session in seconds.
+func (store *RedisStore) indexSession(conn redis.Conn, r *http.Request, s *session, userID string, age int) error {
+	now := time.Now().Unix()
+	infoKey := store.sessionInfoKey(s.id)
+	userKey := store.userSessionsKey(userID)
+
+	ip := r.RemoteAddr
+	if s.context != nil {
+		ip = s.context.ClientIP()
+	}
+
+	// Keep the index as long as the longest session may live.
+	indexAge := age
+	for _, a := range []int{store.Options.MaxAge, store.DefaultMaxAge} {
+		if a > indexAge {
+			indexAge = a
+		}
+	}
+
+	oldUserID, err := redis.String(conn.Do("HGET", infoKey, "user_id"))
+	if err != nil && err != redis.ErrNil {
+		return err
+	}
+
+	conn.Send("MULTI")
+	if oldUserID != "" && oldUserID != userID {
+		conn.Send("ZREM", store.userSessionsKey(oldUserID), s.id)
+	}
+	conn.Send("HMSET", infoKey, "user_id", userID, "user_agent", r.UserAgent(), "ip", ip, "last_seen", now)
+	conn.Send("HSETNX", infoKey, "created_at", now)
+	conn.Send("EXPIRE", infoKey, age)
+	conn.Send("ZADD", userKey, now+int64(age), s.id)
+	conn.Send("ZREMRANGEBYSCORE", userKey, "-inf", now)
+	conn.Send("EXPIRE", userKey, indexAge)
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+// unindexSession deletes the session metadata and removes the session from the index of its user.
+func (store *RedisStore) unindexSession(conn redis.Conn, id string) error {
+	infoKey := store.sessionInfoKey(id)
+
+	userID, err := redis.String(conn.Do("HGET", infoKey, "user_id"))
+	if err == redis.ErrNil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	conn.Send("MULTI")
+	conn.Send("DEL", infoKey)
+	conn.Send("ZREM", store.userSessionsKey(userID), id)
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+// ListUserSessions returns the active sessions of the user,
+// which are associated with the user by SetUserID.
+func (store *RedisStore) ListUserSessions(userID string) ([]SessionInfo, error) {
+	conn := store.Pool.Get()
+	defer conn.Close()
+
+	userKey := store.userSessionsKey(userID)
+	if _, err := conn.Do("ZREMRANGEBYSCORE", userKey, "-inf", time.Now().Unix()); err != nil {
+		return nil, err
+	}
+
+	ids, err := redis.Strings(conn.Do("ZRANGE", userKey, 0, -1))
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]SessionInfo, 0, len(ids))
+	for _, id := range ids {
+		fields, err := redis.StringMap(conn.Do("HGETALL", store.sessionInfoKey(id)))
+		if err != nil {
+			return nil, err
+		}
+		if fields["user_id"] != userID { // expired or associated with another user
+			continue
+		}
+
+		createdAt, _ := strconv.ParseInt(fields["created_at"], 10, 64)
+		lastSeen, _ := strconv.ParseInt(fields["last_seen"], 10, 64)
+		infos = append(infos, SessionInfo{
+			ID:        id,
+			UserID:    fields["user_id"],
+			UserAgent: fields["user_agent"],
+			IP:        fields["ip"],
+			CreatedAt: time.Unix(createdAt, 0),
+			LastSeen:  time.Unix(lastSeen, 0),
+		})
+	}
+	return infos, nil
+}
+
+// RevokeSession destroys the session of the user.
+// It returns ErrSessionNotFound if the session doesn't belong to the user.
+func (store *RedisStore) RevokeSession(userID, id string) error {
+	conn := store.Pool.Get()
+	defer conn.Close()
+
+	owner, err := redis.String(conn.Do("HGET", store.sessionInfoKey(id), "user_id"))
+	if err == redis.ErrNil || (err == nil && owner != userID) {
+		return ErrSessionNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	conn.Send("MULTI")
+	conn.Send("DEL", store.keyPrefix+id, store.sessionInfoKey(id))
+	conn.Send("ZREM", store.userSessionsKey(userID), id)
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+// RevokeUserSessions destroys all sessions of the user.
+func (store *RedisStore) RevokeUserSessions(userID string) error {
+	conn := store.Pool.Get()
+	defer conn.Close()
+
+	userKey := store.userSessionsKey(userID)
+	ids, err := redis.Strings(conn.Do("ZRANGE", userKey, 0, -1))
+	if err != nil {
+		return err
+	}
+
+	keys := redis.Args{userKey}
+	for _, id := range ids {
+		keys = keys.Add(store.keyPrefix+id, store.sessionInfoKey(id))
+	}
+	_, err = conn.Do("DEL", keys...)
+	return err
+}
@@ -1,7 +1,9 @@
 package session
 
 import (
+	"encoding/gob"
 	"log"
+	"time"
 	"github.com/ridewindx/mel"
 )
 
@@ -12,8 +14,18 @@ var ContextKey  = "SESSION"
 // Default key for flashes storing into session.
 const flashesKey = "_flash"
 
+// Key for the user ID storing into session.
+const userIDKey = "_user_id"
+
+func init() {
+	// Flashes are stored as []interface{}, which gob must know to encode,
+	// so are time.Time values.
+	gob.Register([]interface{}{})
+	gob.Register(time.Time{})
+}
+
 // Options stores configuration for a session or session store.
-// Fields are a subset of http.Cookie fields.
+// Fields are a subset of http.Cookie fields, plus the session timeouts.
 type Options struct {
 	Path   string
 	Domain string
@@ -23,39 +35,107 @@ type Options struct {
 	MaxAge   int
 	Secure   bool
 	HttpOnly bool
+
+	// IdleTimeout is the duration after the last request in which the session expires,
+	// which is extended on every request.
+	// CookieStore, MemoryStore and SQLStore re-save the session on every request to extend it,
+	// so the session must be saved by Save or AutoSave.
+	// 0 means no idle timeout.
+	IdleTimeout time.Duration
+
+	// MaxLifetime is the duration after the creation of the session,
+	// after which the session is destroyed regardless of activity.
+	// 0 means no maximum lifetime.
+	MaxLifetime time.Duration
 }
 
 // Middleware returns a middleware that handles session.
 func Middleware(name string, store Store) mel.Handler {
 	return func(c *mel.Context) {
-		s := &session{
-			Name: name,
-			Contents: make(Contents),
-			store: store,
-			context: c,
-		}
-		err := s.store.Get(c.Request, s.Name, s)
-		if err != nil {
-			log.Printf("session: %s\n", err)
+		load(c, name, store)
+		c.Next()
+	}
+}
+
+// AutoSave returns a middleware that handles session like Middleware,
+// and also saves the session if changed before the response is written,
+// so that handlers never have to call Save explicitly.
+func AutoSave(name string, store Store) mel.Handler {
+	return func(c *mel.Context) {
+		w := &autoSaveWriter{
+			ResponseWriter: c.Writer,
+			session: load(c, name, store),
 		}
-		c.Set(ContextKey, s)
+		c.Writer = w
 		c.Next()
+
+		// Nothing has been written.
+		w.save()
 	}
 }
 
-// Session gets session for current request.
-func Session(c *mel.Context) *session {
-	return c.MustGet(ContextKey).(*session)
+// load loads the session from the store into context.
+func load(c *mel.Context, name string, store Store) *session {
+	s := &session{
+		name: name,
+		Contents: make(Contents),
+		store: store,
+		context: c,
+	}
+	err := s.store.Get(c.Request, s.name, s)
+	if err != nil {
+		log.Printf("session: %s\n", err)
+	}
+	c.Set(ContextKey, s)
+	return s
+}
+
+// Default gets session for current request.
+func Default(c *mel.Context) Session {
+	return c.MustGet(ContextKey).(Session)
+}
+
+// Session is the session of a request.
+type Session interface {
+	// Name returns the session name.
+	Name() string
+
+	// ID returns the session ID, which is empty for new sessions
+	// and sessions stored in cookies.
+	ID() string
+
+	// Options returns the options of the session, which take effect on save,
+	// i.e., setting MaxAge to -1 deletes the session.
+	Options() *Options
+
+	Get(key interface{}) (interface{}, bool)
+	GetString(key interface{}) (string, bool, error)
+	GetInt(key interface{}) (int, bool, error)
+	GetTime(key interface{}) (time.Time, bool, error)
+	Set(key interface{}, value interface{})
+	Delete(key interface{})
+	Clear()
+
+	AddFlash(args ...string)
+	Flashes(args ...string) []interface{}
+
+	SetUserID(userID string)
+	UserID() string
+
+	Save() error
+	Regenerate() error
 }
 
+var _ Session = &session{}
+
 type Contents map[interface{}]interface{}
 
 type session struct {
 	// Session name.
-	Name     string
+	name     string
 
 	// Session ID.
-	ID       string
+	id       string
 
 	// Key-value pairs for holding your session contents.
 	Contents
@@ -67,11 +147,24 @@ type session struct {
 
 	context *mel.Context
 
-	*Options
+	options *Options
+}
+
+func (s *session) Name() string {
+	return s.name
+}
+
+func (s *session) ID() string {
+	return s.id
+}
+
+func (s *session) Options() *Options {
+	return s.options
 }
 
 func (s *session) Get(key interface{}) (interface{}, bool) {
-	return s.Contents[key]
+	value, ok := s.Contents[key]
+	return value, ok
 }
 
 func (s *session) Set(key interface{}, value interface{}) {
@@ -84,11 +177,30 @@ func (s *session) Delete(key interface{}) {
 	s.changed = true
 }
 
+// Clear deletes all contents of the session,
+// except the creation time which MaxLifetime is enforced by.
 func (s *session) Clear() {
-	s.Contents = make(Contents)
+	contents := make(Contents)
+	if created, ok := s.Contents[createdAtKey]; ok {
+		contents[createdAtKey] = created
+	}
+	s.Contents = contents
 	s.changed = true
 }
 
+// SetUserID associates the session with the user,
+// so that stores supporting per-user session index, i.e., RedisStore,
+// can list and revoke the sessions of the user.
+func (s *session) SetUserID(userID string) {
+	s.Set(userIDKey, userID)
+}
+
+// UserID returns the user ID associated with the session by SetUserID.
+func (s *session) UserID() string {
+	userID, _ := s.Contents[userIDKey].(string)
+	return userID
+}
+
 func (s *session) AddFlash(args ...string) {
 	key := flashesKey
 	value := args[0]
@@ -101,6 +213,7 @@ func (s *session) AddFlash(args ...string) {
 		flashes = v.([]interface{})
 	}
 	s.Contents[key] = append(flashes, value)
+	s.changed = true
 }
 
 func (s *session) Flashes(args ...string) []interface{} {
@@ -110,6 +223,7 @@ func (s *session) Flashes(args ...string) []interface{} {
 	}
 	if v, ok := s.Contents[key]; ok {
 		delete(s.Contents, key)
+		s.changed = true
 		return v.([]interface{})
 	}
 	return nil
@@ -126,3 +240,14 @@ func (s *session) Save() error {
 	}
 	return err
 }
+
+// Regenerate moves the session contents to a new session ID,
+// invalidates the old one, and sets the new session cookie.
+// Call it after login or any privilege change to prevent session fixation.
+func (s *session) Regenerate() error {
+	err := s.store.Regenerate(s.context.Request, s.context.Writer, s)
+	if err == nil {
+		s.changed = false
+	}
+	return err
+}
@@ -0,0 +1,658 @@
+package session
+
+import (
+	"database/sql/driver"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gorilla/securecookie"
+	"github.com/ridewindx/mel"
+	"github.com/stretchr/testify/assert"
+)
+
+// sessionRequest performs a request with the cookies,
+// and returns the response and the cookies for the next request.
+func sessionRequest(app http.Handler, path string, cookies []*http.Cookie) (*httptest.ResponseRecorder, []*http.Cookie) {
+	req := httptest.NewRequest("GET", path, nil)
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, req)
+
+	if set := w.Result().Cookies(); len(set) > 0 {
+		cookies = set
+	}
+	return w, cookies
+}
+
+func TestAutoSave(t *testing.T) {
+	app := mel.New()
+	app.Use(AutoSave("session", NewCookieStore([]byte("secret"))))
+	app.Get("/set", func(c *mel.Context) {
+		Default(c).Set("name", "alice")
+		c.Text(200, "ok")
+	})
+	app.Get("/flush", func(c *mel.Context) {
+		Default(c).Set("name", "bob")
+		c.Writer.Flush()
+		c.Writer.WriteString("ok")
+	})
+	app.Get("/status", func(c *mel.Context) {
+		Default(c).AddFlash("hello")
+		c.Status(204)
+	})
+	app.Get("/get", func(c *mel.Context) {
+		name, _ := Default(c).Get("name")
+		c.Text(200, "%v %v", name, Default(c).Flashes())
+	})
+
+	w, cookies := sessionRequest(app, "/set", nil)
+	assert.Equal(t, 1, len(w.Result().Cookies()))
+	w, cookies = sessionRequest(app, "/get", cookies)
+	assert.Equal(t, "alice []", w.Body.String())
+
+	// Unchanged sessions are not saved.
+	assert.Equal(t, 0, len(w.Result().Cookies()))
+
+	w, cookies = sessionRequest(app, "/flush", cookies)
+	assert.Equal(t, 1, len(w.Result().Cookies()))
+	w, cookies = sessionRequest(app, "/get", cookies)
+	assert.Equal(t, "bob []", w.Body.String())
+
+	w, cookies = sessionRequest(app, "/status", cookies)
+	assert.Equal(t, 204, w.Code)
+	w, cookies = sessionRequest(app, "/get", cookies)
+	assert.Equal(t, "bob [hello]", w.Body.String())
+}
+
+func TestMemoryStore(t *testing.T) {
+	store := NewMemoryStore(time.Millisecond)
+	defer store.Close()
+
+	app := mel.New()
+	app.Use(AutoSave("session", store))
+	app.Get("/login", func(c *mel.Context) {
+		s := Default(c)
+		s.Set("name", "alice")
+		assert.NoError(t, s.Regenerate())
+	})
+	app.Get("/get", func(c *mel.Context) {
+		name, _ := Default(c).Get("name")
+		c.Text(200, "%v", name)
+	})
+	app.Get("/logout", func(c *mel.Context) {
+		s := Default(c)
+		s.Options().MaxAge = -1
+		s.Clear()
+	})
+
+	_, cookies := sessionRequest(app, "/login", nil)
+	assert.Equal(t, 1, store.Len())
+	firstID := cookies[0].Value
+
+	contents, ok := store.Contents(firstID)
+	assert.True(t, ok)
+	assert.Equal(t, "alice", contents["name"])
+
+	w, _ := sessionRequest(app, "/get", cookies)
+	assert.Equal(t, "alice", w.Body.String())
+
+	// Login again with the session, the old ID is dropped.
+	_, cookies = sessionRequest(app, "/login", cookies)
+	assert.NotEqual(t, firstID, cookies[0].Value)
+	assert.Equal(t, []string{cookies[0].Value}, store.IDs())
+
+	w, _ = sessionRequest(app, "/get", []*http.Cookie{{Name: "session", Value: firstID}})
+	assert.Equal(t, "<nil>", w.Body.String())
+
+	_, cookies = sessionRequest(app, "/logout", cookies)
+	assert.Equal(t, 0, store.Len())
+
+	// Expired sessions are deleted by the janitor.
+	_, cookies = sessionRequest(app, "/login", nil)
+	store.mu.Lock()
+	store.sessions[cookies[0].Value] = memorySession{expires: time.Now()}
+	store.mu.Unlock()
+
+	assert.Eventually(t, func() bool {
+		store.mu.RLock()
+		defer store.mu.RUnlock()
+		return len(store.sessions) == 0
+	}, time.Second, time.Millisecond)
+}
+
+func TestSQLStore(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	mock.ExpectExec(regexp.QuoteMeta(
+		"CREATE TABLE IF NOT EXISTS sessions (id VARCHAR(64) NOT NULL PRIMARY KEY, data BYTEA NOT NULL, expires BIGINT NOT NULL)")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("CREATE INDEX IF NOT EXISTS sessions_expires_idx ON sessions (expires)")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	store, err := NewSQLStore(db, "postgres", "sessions", []byte("secret"))
+	assert.NoError(t, err)
+	defer store.Close()
+
+	app := mel.New()
+	app.Use(AutoSave("session", store))
+	app.Get("/set", func(c *mel.Context) {
+		Default(c).Set("name", "alice")
+	})
+	app.Get("/get", func(c *mel.Context) {
+		name, _ := Default(c).Get("name")
+		c.Text(200, "%v", name)
+	})
+
+	var data []byte
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO sessions (id, data, expires) VALUES ($1, $2, $3) "+
+		"ON CONFLICT (id) DO UPDATE SET data = EXCLUDED.data, expires = EXCLUDED.expires")).
+		WithArgs(sqlmock.AnyArg(), argCapture{&data}, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	_, cookies := sessionRequest(app, "/set", nil)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT data FROM sessions WHERE id = $1 AND expires >= $2")).
+		WillReturnRows(sqlmock.NewRows([]string{"data"}).AddRow(data))
+
+	w, _ := sessionRequest(app, "/get", cookies)
+	assert.Equal(t, "alice", w.Body.String())
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT data FROM sessions WHERE id = $1 AND expires >= $2")).
+		WillReturnRows(sqlmock.NewRows([]string{"data"}))
+
+	w, _ = sessionRequest(app, "/get", cookies)
+	assert.Equal(t, "<nil>", w.Body.String())
+
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM sessions WHERE expires < $1")).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	assert.NoError(t, store.DeleteExpired())
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSQLStoreUpdateOrInsert(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	store := &SQLStore{DB: db, table: "sessions", dialect: dialectOf("unknown")}
+
+	// Existing rows are updated.
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE sessions SET data = ?, expires = ? WHERE id = ?")).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	assert.NoError(t, store.updateOrInsert("id", []byte("data"), 1))
+
+	// Missing rows are inserted.
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE sessions SET data = ?, expires = ? WHERE id = ?")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO sessions (id, data, expires) VALUES (?, ?, ?)")).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	assert.NoError(t, store.updateOrInsert("id", []byte("data"), 1))
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+// argCapture captures a []byte query argument.
+type argCapture struct {
+	data *[]byte
+}
+
+func (a argCapture) Match(v driver.Value) bool {
+	*a.data, _ = v.([]byte)
+	return true
+}
+
+func newTimeoutTestApp(store Store) *mel.Mel {
+	app := mel.New()
+	app.Use(AutoSave("session", store))
+	app.Get("/set", func(c *mel.Context) {
+		Default(c).Set("name", "alice")
+	})
+	app.Get("/get", func(c *mel.Context) {
+		name, _ := Default(c).Get("name")
+		c.Text(200, "%v", name)
+	})
+	app.Get("/age", func(c *mel.Context) {
+		// Pretend the session was created and accessed long ago.
+		ago, err := time.ParseDuration(c.Query("ago"))
+		if err != nil {
+			ago = 2 * time.Hour
+		}
+		Default(c).Set(createdAtKey, time.Now().Add(-ago).Unix())
+		Default(c).Set(accessedAtKey, time.Now().Add(-ago).Unix())
+	})
+	app.Get("/clear", func(c *mel.Context) {
+		Default(c).Clear()
+	})
+	return app
+}
+
+func TestCookieStoreTimeouts(t *testing.T) {
+	store := NewCookieStore([]byte("secret"))
+	store.IdleTimeout = time.Hour
+	store.MaxLifetime = 24 * time.Hour
+	app := newTimeoutTestApp(store)
+
+	_, cookies := sessionRequest(app, "/set", nil)
+
+	// The cookie is re-issued on every request to extend the idle timeout.
+	w, cookies := sessionRequest(app, "/get", cookies)
+	assert.Equal(t, "alice", w.Body.String())
+	assert.Equal(t, 1, len(w.Result().Cookies()))
+
+	// Idle for too long.
+	_, cookies = sessionRequest(app, "/age", cookies)
+	w, _ = sessionRequest(app, "/get", cookies)
+	assert.Equal(t, "<nil>", w.Body.String())
+
+	// Too old, regardless of activity.
+	store.IdleTimeout = 0
+	store.MaxLifetime = time.Hour
+	_, cookies = sessionRequest(app, "/set", nil)
+	w, cookies = sessionRequest(app, "/get", cookies)
+	assert.Equal(t, "alice", w.Body.String())
+	_, cookies = sessionRequest(app, "/age", cookies)
+	w, _ = sessionRequest(app, "/get", cookies)
+	assert.Equal(t, "<nil>", w.Body.String())
+}
+
+func TestMemoryStoreTimeouts(t *testing.T) {
+	store := NewMemoryStore(0)
+	store.IdleTimeout = time.Hour
+	store.MaxLifetime = 24 * time.Hour
+	app := newTimeoutTestApp(store)
+
+	_, cookies := sessionRequest(app, "/set", nil)
+
+	// The session is saved on every request to extend the idle timeout.
+	w, _ := sessionRequest(app, "/get", cookies)
+	assert.Equal(t, "alice", w.Body.String())
+	assert.Equal(t, 1, len(w.Result().Cookies()))
+
+	// Idle for too long.
+	sessionRequest(app, "/age", cookies)
+	w, _ = sessionRequest(app, "/get", cookies)
+	assert.Equal(t, "<nil>", w.Body.String())
+
+	// Too old, regardless of activity.
+	store.IdleTimeout = 0
+	store.MaxLifetime = time.Hour
+	_, cookies = sessionRequest(app, "/set", nil)
+	sessionRequest(app, "/age", cookies)
+	assert.Equal(t, 0, store.Len())
+	w, _ = sessionRequest(app, "/get", cookies)
+	assert.Equal(t, "<nil>", w.Body.String())
+}
+
+func TestRedisStoreTimeouts(t *testing.T) {
+	mr := miniredis.RunT(t)
+	store, err := NewRedisStore(1, "tcp", mr.Addr(), "", []byte("secret"))
+	assert.NoError(t, err)
+	defer store.Close()
+	store.IdleTimeout = time.Minute
+	store.MaxLifetime = time.Hour
+	app := newTimeoutTestApp(store)
+
+	_, cookies := sessionRequest(app, "/set", nil)
+	keys := mr.Keys()
+	assert.Equal(t, 1, len(keys))
+	assert.Equal(t, time.Minute, mr.TTL(keys[0]))
+
+	// Sliding expiration.
+	mr.FastForward(50 * time.Second)
+	w, _ := sessionRequest(app, "/get", cookies)
+	assert.Equal(t, "alice", w.Body.String())
+	assert.Equal(t, time.Minute, mr.TTL(keys[0]))
+
+	mr.FastForward(2 * time.Minute)
+	w, _ = sessionRequest(app, "/get", cookies)
+	assert.Equal(t, "<nil>", w.Body.String())
+
+	// Destroyed after the maximum lifetime.
+	_, cookies = sessionRequest(app, "/set", nil)
+	_, cookies = sessionRequest(app, "/age", cookies)
+	assert.Equal(t, 0, len(mr.Keys()))
+	w, _ = sessionRequest(app, "/get", cookies)
+	assert.Equal(t, "<nil>", w.Body.String())
+
+	// Clearing the session doesn't restart its lifetime.
+	mr.FlushAll()
+	_, cookies = sessionRequest(app, "/set", nil)
+	sessionRequest(app, "/age?ago=59m30s", cookies)
+	sessionRequest(app, "/clear", cookies)
+	keys = mr.Keys()
+	assert.Equal(t, 1, len(keys))
+	assert.True(t, mr.TTL(keys[0]) <= 30*time.Second)
+
+	// The sliding expiration is capped by MaxAge.
+	mr.FlushAll()
+	store.IdleTimeout = 0
+	store.MaxLifetime = 24 * time.Hour
+	store.Options.MaxAge = 60
+	_, cookies = sessionRequest(app, "/set", nil)
+	keys = mr.Keys()
+	assert.Equal(t, time.Minute, mr.TTL(keys[0]))
+	sessionRequest(app, "/get", cookies)
+	assert.Equal(t, time.Minute, mr.TTL(keys[0]))
+}
+
+func TestRedisStoreUserSessions(t *testing.T) {
+	mr := miniredis.RunT(t)
+	store, err := NewRedisStore(1, "tcp", mr.Addr(), "", []byte("secret"))
+	assert.NoError(t, err)
+	defer store.Close()
+
+	app := mel.New()
+	app.Use(AutoSave("session", store))
+	app.Get("/login", func(c *mel.Context) {
+		s := Default(c)
+		s.SetUserID(c.Query("user"))
+		assert.NoError(t, s.Regenerate())
+	})
+	app.Get("/get", func(c *mel.Context) {
+		c.Text(200, "%s", Default(c).UserID())
+	})
+	app.Get("/switch", func(c *mel.Context) {
+		// Change the user without regenerating the session.
+		Default(c).SetUserID(c.Query("user"))
+	})
+	app.Get("/clear", func(c *mel.Context) {
+		Default(c).Clear()
+	})
+	app.Get("/logout", func(c *mel.Context) {
+		s := Default(c)
+		s.Options().MaxAge = -1
+		s.Clear()
+	})
+
+	_, phone := sessionRequest(app, "/login?user=alice", nil)
+	_, laptop := sessionRequest(app, "/login?user=alice", nil)
+	_, other := sessionRequest(app, "/login?user=bob", nil)
+
+	sessions, err := store.ListUserSessions("alice")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(sessions))
+	for _, info := range sessions {
+		assert.Equal(t, "alice", info.UserID)
+		assert.NotEmpty(t, info.IP)
+		assert.False(t, info.LastSeen.IsZero())
+	}
+
+	// Regenerated sessions replace the old ones in the index.
+	_, laptop = sessionRequest(app, "/login?user=alice", laptop)
+	sessions, _ = store.ListUserSessions("alice")
+	assert.Equal(t, 2, len(sessions))
+
+	// Sessions of other users can't be revoked.
+	bobSessions, _ := store.ListUserSessions("bob")
+	assert.Equal(t, ErrSessionNotFound, store.RevokeSession("alice", bobSessions[0].ID))
+
+	var phoneID string
+	assert.NoError(t, securecookie.DecodeMulti("session", phone[0].Value, &phoneID, store.Codecs...))
+	assert.NoError(t, store.RevokeSession("alice", phoneID))
+	w, _ := sessionRequest(app, "/get", phone)
+	assert.Equal(t, "", w.Body.String())
+
+	sessions, _ = store.ListUserSessions("alice")
+	assert.Equal(t, 1, len(sessions))
+
+	// Logout removes the session from the index.
+	sessionRequest(app, "/logout", laptop)
+	w, _ = sessionRequest(app, "/get", laptop)
+	assert.Equal(t, "", w.Body.String())
+	sessions, _ = store.ListUserSessions("alice")
+	assert.Equal(t, 0, len(sessions))
+
+	assert.NoError(t, store.RevokeUserSessions("bob"))
+	w, _ = sessionRequest(app, "/get", other)
+	assert.Equal(t, "", w.Body.String())
+	sessions, _ = store.ListUserSessions("bob")
+	assert.Equal(t, 0, len(sessions))
+
+	// Changing the user moves the session to the index of the new user.
+	_, cookies := sessionRequest(app, "/login?user=alice", nil)
+	sessionRequest(app, "/switch?user=carol", cookies)
+	sessions, _ = store.ListUserSessions("alice")
+	assert.Equal(t, 0, len(sessions))
+	sessions, _ = store.ListUserSessions("carol")
+	assert.Equal(t, 1, len(sessions))
+	assert.Equal(t, ErrSessionNotFound, store.RevokeSession("alice", sessions[0].ID))
+	w, _ = sessionRequest(app, "/get", cookies)
+	assert.Equal(t, "carol", w.Body.String())
+
+	// Clearing the session removes it from the index.
+	sessionRequest(app, "/clear", cookies)
+	sessions, _ = store.ListUserSessions("carol")
+	assert.Equal(t, 0, len(sessions))
+}
+
+func TestCookieStoreChunks(t *testing.T) {
+	app := mel.New()
+	app.Use(AutoSave("session", NewCookieStore([]byte("secret"))))
+	app.Get("/set", func(c *mel.Context) {
+		n, _ := strconv.Atoi(c.Query("n"))
+		Default(c).Set("data", strings.Repeat("x", n))
+	})
+	app.Get("/get", func(c *mel.Context) {
+		data, _ := Default(c).Get("data")
+		c.Text(200, "%d", len(data.(string)))
+	})
+
+	// live returns the cookies which are not deleted.
+	live := func(cookies []*http.Cookie) []*http.Cookie {
+		var live []*http.Cookie
+		for _, cookie := range cookies {
+			if cookie.MaxAge >= 0 {
+				live = append(live, cookie)
+			}
+		}
+		return live
+	}
+
+	w, _ := sessionRequest(app, "/set?n=10000", nil)
+	big := live(w.Result().Cookies())
+	assert.True(t, len(big) > 2)
+	for i, cookie := range big {
+		assert.Equal(t, "session."+strconv.Itoa(i), cookie.Name)
+		assert.True(t, len(cookie.Value) <= cookieChunkSize)
+	}
+	w, _ = sessionRequest(app, "/get", big)
+	assert.Equal(t, "10000", w.Body.String())
+
+	// Stale chunks are deleted when the session shrinks.
+	w, _ = sessionRequest(app, "/set?n=3000", big)
+	small := live(w.Result().Cookies())
+	assert.True(t, len(small) > 1 && len(small) < len(big))
+	assert.Equal(t, len(big), len(w.Result().Cookies()))
+	w, _ = sessionRequest(app, "/get", small)
+	assert.Equal(t, "3000", w.Body.String())
+
+	w, _ = sessionRequest(app, "/set?n=10", small)
+	single := live(w.Result().Cookies())
+	assert.Equal(t, 1, len(single))
+	assert.Equal(t, "session", single[0].Name)
+	assert.Equal(t, len(small)+1, len(w.Result().Cookies()))
+	w, _ = sessionRequest(app, "/get", single)
+	assert.Equal(t, "10", w.Body.String())
+}
+
+func TestTypedAccessors(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+
+	var s Session = &session{Contents: Contents{
+		"name":  "alice",
+		"age":   30,
+		"float": float64(42),
+		"login": now,
+		"json":  now.Format(time.RFC3339),
+	}}
+
+	name, ok, err := s.GetString("name")
+	assert.Equal(t, "alice", name)
+	assert.True(t, ok)
+	assert.NoError(t, err)
+
+	_, ok, err = s.GetString("age")
+	assert.True(t, ok)
+	assert.True(t, errors.Is(err, ErrValueType))
+
+	_, ok, err = s.GetString("missing")
+	assert.False(t, ok)
+	assert.NoError(t, err)
+
+	age, _, err := s.GetInt("age")
+	assert.Equal(t, 30, age)
+	assert.NoError(t, err)
+
+	float, _, err := s.GetInt("float")
+	assert.Equal(t, 42, float)
+	assert.NoError(t, err)
+
+	for _, key := range []string{"login", "json"} {
+		login, _, err := s.GetTime(key)
+		assert.True(t, now.Equal(login))
+		assert.NoError(t, err)
+	}
+
+	age, ok, err = Get[int](s, "age")
+	assert.Equal(t, 30, age)
+	assert.True(t, ok)
+	assert.NoError(t, err)
+
+	_, ok, err = Get[time.Time](s, "name")
+	assert.True(t, ok)
+	assert.True(t, errors.Is(err, ErrValueType))
+}
+
+// mockSession is a Session with a fixed user ID.
+type mockSession struct {
+	Session
+	userID string
+}
+
+func (s *mockSession) UserID() string {
+	return s.userID
+}
+
+func TestMockSession(t *testing.T) {
+	app := mel.New()
+	app.Use(func(c *mel.Context) {
+		c.Set(ContextKey, &mockSession{userID: "alice"})
+		c.Next()
+	})
+	app.Get("/get", func(c *mel.Context) {
+		c.Text(200, "%s", Default(c).UserID())
+	})
+
+	w, _ := sessionRequest(app, "/get", nil)
+	assert.Equal(t, "alice", w.Body.String())
+}
+
+func TestCookieKeyRotation(t *testing.T) {
+	oldKey, newKey := []byte("old secret"), []byte("new secret")
+
+	newApp := func(store Store) *mel.Mel {
+		app := mel.New()
+		app.Use(AutoSave("session", store))
+		app.Get("/set", func(c *mel.Context) {
+			Default(c).Set("name", "alice")
+		})
+		app.Get("/get", func(c *mel.Context) {
+			name, _ := Default(c).Get("name")
+			c.Text(200, "%v", name)
+		})
+		return app
+	}
+
+	_, cookies := sessionRequest(newApp(NewCookieStore(oldKey)), "/set", nil)
+
+	// Decoded with the old key, and re-issued with the new key.
+	rotated := newApp(NewCookieStore(newKey, nil, oldKey, nil))
+	w, cookies := sessionRequest(rotated, "/get", cookies)
+	assert.Equal(t, "alice", w.Body.String())
+	assert.Equal(t, 1, len(w.Result().Cookies()))
+
+	// Cookies of the current key are not re-issued.
+	w, _ = sessionRequest(rotated, "/get", cookies)
+	assert.Equal(t, "alice", w.Body.String())
+	assert.Equal(t, 0, len(w.Result().Cookies()))
+
+	// The old key can be retired.
+	w, _ = sessionRequest(newApp(NewCookieStore(newKey)), "/get", cookies)
+	assert.Equal(t, "alice", w.Body.String())
+
+	// So do the IDs of server-side sessions.
+	mr := miniredis.RunT(t)
+	oldStore, err := NewRedisStore(1, "tcp", mr.Addr(), "", oldKey)
+	assert.NoError(t, err)
+	defer oldStore.Close()
+	rotatedStore, err := NewRedisStore(1, "tcp", mr.Addr(), "", newKey, nil, oldKey, nil)
+	assert.NoError(t, err)
+	defer rotatedStore.Close()
+
+	_, cookies = sessionRequest(newApp(oldStore), "/set", nil)
+	w, cookies = sessionRequest(newApp(rotatedStore), "/get", cookies)
+	assert.Equal(t, "alice", w.Body.String())
+	assert.Equal(t, 1, len(w.Result().Cookies()))
+
+	newStore, err := NewRedisStore(1, "tcp", mr.Addr(), "", newKey)
+	assert.NoError(t, err)
+	defer newStore.Close()
+	w, _ = sessionRequest(newApp(newStore), "/get", cookies)
+	assert.Equal(t, "alice", w.Body.String())
+}
+
+func TestRegenerate(t *testing.T) {
+	mr := miniredis.RunT(t)
+	redisStore, err := NewRedisStore(1, "tcp", mr.Addr(), "", []byte("secret"))
+	assert.NoError(t, err)
+	defer redisStore.Close()
+
+	for _, store := range []Store{NewCookieStore([]byte("secret")), redisStore} {
+		app := mel.New()
+		app.Use(Middleware("session", store))
+		app.Get("/set", func(c *mel.Context) {
+			Default(c).Set("name", "alice")
+			assert.NoError(t, Default(c).Save())
+		})
+		app.Get("/login", func(c *mel.Context) {
+			assert.NoError(t, Default(c).Regenerate())
+		})
+		app.Get("/get", func(c *mel.Context) {
+			name, _ := Default(c).Get("name")
+			c.Text(200, "%v", name)
+		})
+
+		_, cookies := sessionRequest(app, "/set", nil)
+		oldKeys := mr.Keys()
+
+		w, newCookies := sessionRequest(app, "/login", cookies)
+		assert.Equal(t, 1, len(w.Result().Cookies()))
+
+		w, _ = sessionRequest(app, "/get", newCookies)
+		assert.Equal(t, "alice", w.Body.String())
+
+		if store == redisStore {
+			// The old ID is deleted.
+			assert.NotEqual(t, cookies[0].Value, newCookies[0].Value)
+			assert.Equal(t, 1, len(oldKeys))
+			assert.False(t, mr.Exists(oldKeys[0]))
+			assert.Equal(t, 1, len(mr.Keys()))
+
+			w, _ = sessionRequest(app, "/get", cookies)
+			assert.Equal(t, "<nil>", w.Body.String())
+		}
+	}
+}
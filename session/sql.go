@@ -0,0 +1,327 @@
+package session
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/securecookie"
+)
+
+// SQLStore stores sessions in a database table,
+// for small deployments which don't want to run Redis.
+// The table is created if it doesn't exist, with an indexed expiry column,
+// and expired rows are deleted periodically until the store is closed.
+type SQLStore struct {
+	DB *sql.DB
+
+	Codecs   []securecookie.Codec
+	*Options // default configuration
+
+	DefaultMaxAge int // default TTL for a MaxAge == 0 session
+
+	table      string
+	dialect    sqlDialect
+	serializer SessionSerializer
+
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+// sqlDialect holds the SQL differences of databases.
+type sqlDialect struct {
+	// placeholder returns the i-th (starting from 1) bind parameter.
+	placeholder func(i int) string
+
+	blobType string
+
+	// inlineIndex reports whether the expiry index is declared in CREATE TABLE,
+	// since MySQL doesn't support CREATE INDEX IF NOT EXISTS.
+	inlineIndex bool
+
+	// upsert is the query inserting or replacing a row of (id, data, expires).
+	// If empty, the row is updated, or inserted if there is none.
+	upsert string
+}
+
+func dialectOf(driver string) sqlDialect {
+	switch driver {
+	case "postgres", "pgx", "cloudsqlpostgres":
+		return sqlDialect{
+			placeholder: func(i int) string { return fmt.Sprintf("$%d", i) },
+			blobType:    "BYTEA",
+			upsert: "INSERT INTO %s (id, data, expires) VALUES (%s, %s, %s) " +
+				"ON CONFLICT (id) DO UPDATE SET data = EXCLUDED.data, expires = EXCLUDED.expires",
+		}
+	case "mysql":
+		return sqlDialect{
+			placeholder: func(i int) string { return "?" },
+			blobType:    "LONGBLOB",
+			inlineIndex: true,
+			upsert: "INSERT INTO %s (id, data, expires) VALUES (%s, %s, %s) " +
+				"ON DUPLICATE KEY UPDATE data = VALUES(data), expires = VALUES(expires)",
+		}
+	case "sqlite3", "sqlite":
+		return sqlDialect{
+			placeholder: func(i int) string { return "?" },
+			blobType:    "BLOB",
+			upsert:      "INSERT OR REPLACE INTO %s (id, data, expires) VALUES (%s, %s, %s)",
+		}
+	default:
+		return sqlDialect{
+			placeholder: func(i int) string { return "?" },
+			blobType:    "BLOB",
+		}
+	}
+}
+
+// Interval of deleting expired sessions from the table.
+var sqlCleanupInterval = 5 * time.Minute
+
+// NewSQLStore returns a new SQLStore which stores sessions in the table.
+// driver is the database driver name, e.g., "mysql", "postgres" or "sqlite3",
+// which selects the SQL dialect. To use the melware DB configuration:
+//
+//	store, err := session.NewSQLStore(melware.DB(app), melware.DBConfig(app).GetString("driver"), "sessions", key)
+//
+// Keys are defined in pairs like NewCookieStore, which are used to encode the session ID into cookies.
+func NewSQLStore(db *sql.DB, driver, table string, keyPairs ...[]byte) (*SQLStore, error) {
+	ss := &SQLStore{
+		DB:     db,
+		Codecs: securecookie.CodecsFromPairs(keyPairs...),
+		Options: &Options{
+			Path:   "/",
+			MaxAge: sessionExpire,
+		},
+		DefaultMaxAge: 60 * 20,
+		table:         table,
+		dialect:       dialectOf(driver),
+		serializer:    GobSerializer{},
+		stop:          make(chan struct{}),
+	}
+
+	if err := ss.createTable(); err != nil {
+		return nil, err
+	}
+
+	go ss.cleanup(sqlCleanupInterval)
+	return ss, nil
+}
+
+func (store *SQLStore) createTable() error {
+	index := ""
+	if store.dialect.inlineIndex {
+		index = fmt.Sprintf(", INDEX %s_expires_idx (expires)", store.table)
+	}
+
+	_, err := store.DB.Exec(fmt.Sprintf(
+		"CREATE TABLE IF NOT EXISTS %s (id VARCHAR(64) NOT NULL PRIMARY KEY, data %s NOT NULL, expires BIGINT NOT NULL%s)",
+		store.table, store.dialect.blobType, index))
+	if err != nil || store.dialect.inlineIndex {
+		return err
+	}
+
+	_, err = store.DB.Exec(fmt.Sprintf(
+		"CREATE INDEX IF NOT EXISTS %s_expires_idx ON %s (expires)", store.table, store.table))
+	return err
+}
+
+func (store *SQLStore) cleanup(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := store.DeleteExpired(); err != nil {
+				log.Printf("session: %s\n", err)
+			}
+		case <-store.stop:
+			return
+		}
+	}
+}
+
+// Close stops deleting expired sessions.
+// The underlying *sql.DB is not closed, since it is usually shared.
+func (store *SQLStore) Close() error {
+	store.closeOnce.Do(func() {
+		close(store.stop)
+	})
+	return nil
+}
+
+// SetSerializer sets the serializer
+func (store *SQLStore) SetSerializer(ss SessionSerializer) {
+	store.serializer = ss
+}
+
+// SetMaxAge restricts the maximum age, in seconds, of the session record
+// both in database and a browser, like RedisStore.SetMaxAge.
+func (store *SQLStore) SetMaxAge(age int) {
+	store.Options.MaxAge = age
+
+	for _, codec := range store.Codecs {
+		if c, ok := codec.(*securecookie.SecureCookie); ok {
+			c.MaxAge(age)
+		} else {
+			log.Printf("Can't change MaxAge on codec %v\n", codec)
+		}
+	}
+}
+
+// DeleteExpired deletes all expired sessions from the table.
+func (store *SQLStore) DeleteExpired() error {
+	_, err := store.DB.Exec(store.query("DELETE FROM %s WHERE expires < %s"), time.Now().Unix())
+	return err
+}
+
+// query formats the query with the table name and the bind parameters.
+func (store *SQLStore) query(format string) string {
+	args := []interface{}{store.table}
+	for i := 1; i < strings.Count(format, "%s"); i++ {
+		args = append(args, store.dialect.placeholder(i))
+	}
+	return fmt.Sprintf(format, args...)
+}
+
+func (store *SQLStore) Get(r *http.Request, name string, s *session) error {
+	// Copy options.
+	options := *store.Options
+	s.options = &options
+
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return err
+	}
+
+	// Decode to get ID.
+	var id string
+	rotated, err := decodeCookie(name, cookie.Value, &id, store.Codecs...)
+	if err != nil {
+		return err
+	}
+
+	var data []byte
+	err = store.DB.QueryRow(store.query("SELECT data FROM %s WHERE id = %s AND expires >= %s"),
+		id, time.Now().Unix()).Scan(&data)
+	if err == sql.ErrNoRows { // no data was associated with the ID
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// Deserialize to get contents.
+	contents := make(Contents)
+	if err := store.serializer.Deserialize(data, &contents); err != nil {
+		return err
+	}
+
+	if s.options.lifetimeExceeded(contents) || s.options.idleExceeded(contents) {
+		// Destroy the session and start over with a new one.
+		return store.delete(id)
+	}
+
+	s.id = id
+	s.Contents = contents
+	// Re-encode the ID with the current key on save.
+	s.changed = rotated
+
+	if s.options.IdleTimeout > 0 {
+		// Save again to extend the idle timeout.
+		s.Contents[accessedAtKey] = time.Now().Unix()
+		s.changed = true
+	}
+	return nil
+}
+
+func (store *SQLStore) Save(r *http.Request, w http.ResponseWriter, s *session) error {
+	s.options.stamp(s.Contents)
+	age := s.options.expiry(s.Contents, store.DefaultMaxAge)
+
+	// A session past MaxLifetime is deleted as if MaxAge were negative.
+	if s.options.MaxAge < 0 || age == 0 {
+		// Delete ID from the table.
+		if s.id != "" {
+			if err := store.delete(s.id); err != nil {
+				return err
+			}
+		}
+		expired := *s.options
+		expired.MaxAge = -1
+		http.SetCookie(w, newCookie(s.name, "", &expired))
+		return nil
+	}
+
+	if s.id == "" {
+		s.id = generateID()
+	}
+
+	// Serialize to put contents.
+	data, err := store.serializer.Serialize(s.Contents)
+	if err != nil {
+		return err
+	}
+
+	expires := time.Now().Add(time.Duration(age) * time.Second).Unix()
+
+	// Upsert the row, so that concurrent saves of the session don't conflict.
+	if store.dialect.upsert != "" {
+		_, err = store.DB.Exec(store.query(store.dialect.upsert), s.id, data, expires)
+	} else {
+		err = store.updateOrInsert(s.id, data, expires)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Encode to put ID.
+	value, err := securecookie.EncodeMulti(s.name, s.id, store.Codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, newCookie(s.name, value, s.options))
+	return nil
+}
+
+// Regenerate saves the session contents under a new ID,
+// and deletes the old ID from the table.
+func (store *SQLStore) Regenerate(r *http.Request, w http.ResponseWriter, s *session) error {
+	oldID := s.id
+	s.id = generateID()
+
+	if err := store.Save(r, w, s); err != nil {
+		s.id = oldID
+		return err
+	}
+
+	if oldID == "" {
+		return nil
+	}
+	return store.delete(oldID)
+}
+
+// updateOrInsert updates the row of the session, or inserts it if there is none,
+// for databases whose upsert syntax is unknown.
+func (store *SQLStore) updateOrInsert(id string, data []byte, expires int64) error {
+	result, err := store.DB.Exec(store.query("UPDATE %s SET data = %s, expires = %s WHERE id = %s"), data, expires, id)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+
+	_, err = store.DB.Exec(store.query("INSERT INTO %s (id, data, expires) VALUES (%s, %s, %s)"), id, data, expires)
+	return err
+}
+
+func (store *SQLStore) delete(id string) error {
+	_, err := store.DB.Exec(store.query("DELETE FROM %s WHERE id = %s"), id)
+	return err
+}
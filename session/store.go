@@ -1,8 +1,12 @@
 package session
 
 import (
+	"encoding/json"
+	"math"
 	"net/http"
 	"time"
+
+	"github.com/gorilla/securecookie"
 )
 
 // Amount of time for session keys to expire.
@@ -12,6 +16,113 @@ type Store interface {
 	Get(r *http.Request, name string, s *session) error
 
 	Save(r *http.Request, w http.ResponseWriter, s *session) error
+
+	// Regenerate saves the session under a new ID and deletes the old one.
+	Regenerate(r *http.Request, w http.ResponseWriter, s *session) error
+}
+
+// Keys of timestamps storing into session contents for enforcing
+// Options.IdleTimeout and Options.MaxLifetime.
+const (
+	createdAtKey  = "_created_at"
+	accessedAtKey = "_accessed_at"
+)
+
+// stamp records the creation time into the contents if not yet,
+// and the access time if there is an idle timeout.
+func (o *Options) stamp(contents Contents) {
+	now := time.Now().Unix()
+	if _, ok := contents[createdAtKey]; !ok {
+		contents[createdAtKey] = now
+	}
+	if _, ok := contents[accessedAtKey]; !ok && o.IdleTimeout > 0 {
+		contents[accessedAtKey] = now
+	}
+}
+
+// lifetimeExceeded reports whether the session has exceeded MaxLifetime.
+func (o *Options) lifetimeExceeded(contents Contents) bool {
+	created, ok := timestamp(contents, createdAtKey)
+	return ok && o.MaxLifetime > 0 && time.Now().After(created.Add(o.MaxLifetime))
+}
+
+// idleExceeded reports whether the session has not been accessed in IdleTimeout.
+func (o *Options) idleExceeded(contents Contents) bool {
+	accessed, ok := timestamp(contents, accessedAtKey)
+	return ok && o.IdleTimeout > 0 && time.Now().After(accessed.Add(o.IdleTimeout))
+}
+
+// timeoutTTL returns the duration until the session times out if not accessed again,
+// i.e., the shorter of IdleTimeout and the rest of MaxLifetime,
+// which is not positive if the session has exceeded MaxLifetime.
+// It returns false if there are no timeouts.
+func (o *Options) timeoutTTL(contents Contents) (time.Duration, bool) {
+	ttl, ok := o.IdleTimeout, o.IdleTimeout > 0
+	if created, found := timestamp(contents, createdAtKey); found && o.MaxLifetime > 0 {
+		rest := time.Until(created.Add(o.MaxLifetime))
+		if !ok || rest < ttl {
+			ttl, ok = rest, true
+		}
+	}
+	return ttl, ok
+}
+
+// expiry returns the TTL of the session in seconds, which is MaxAge or defaultMaxAge
+// capped by the session timeouts. It returns 0 if the session has timed out.
+func (o *Options) expiry(contents Contents, defaultMaxAge int) int {
+	age := o.MaxAge
+	if age == 0 {
+		age = defaultMaxAge
+	}
+
+	if ttl, ok := o.timeoutTTL(contents); ok {
+		if ttl <= 0 {
+			return 0
+		}
+		if seconds(ttl) < age {
+			age = seconds(ttl)
+		}
+	}
+	return age
+}
+
+// timestamp reads a Unix time from the contents,
+// which may have been turned into float64 or json.Number by serializers.
+func timestamp(contents Contents, key interface{}) (time.Time, bool) {
+	switch v := contents[key].(type) {
+	case int64:
+		return time.Unix(v, 0), true
+	case float64:
+		return time.Unix(int64(v), 0), true
+	case json.Number:
+		n, err := v.Int64()
+		return time.Unix(n, 0), err == nil
+	}
+	return time.Time{}, false
+}
+
+// seconds returns the duration in whole seconds rounded up, at least 1.
+func seconds(d time.Duration) int {
+	return int(math.Max(1, math.Ceil(d.Seconds())))
+}
+
+// decodeCookie decodes the cookie value like securecookie.DecodeMulti,
+// and reports whether it was decoded by a codec other than the first one,
+// i.e., encoded with a rotated out key, so that it should be re-encoded.
+func decodeCookie(name, value string, dst interface{}, codecs ...securecookie.Codec) (bool, error) {
+	if len(codecs) == 0 {
+		return false, securecookie.DecodeMulti(name, value, dst)
+	}
+
+	var errs securecookie.MultiError
+	for i, codec := range codecs {
+		err := codec.Decode(name, value, dst)
+		if err == nil {
+			return i > 0, nil
+		}
+		errs = append(errs, err)
+	}
+	return false, errs
 }
 
 // newCookie returns an http.Cookie with the options set. It also sets
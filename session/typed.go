@@ -0,0 +1,84 @@
+package session
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// ErrValueType is the error of session values which are not of the expected type.
+var ErrValueType = errors.New("session: unexpected value type")
+
+// Get returns the value of the key in the session as type T.
+// It returns false if the key doesn't exist, and ErrValueType if the value is not a T.
+func Get[T any](s Session, key interface{}) (T, bool, error) {
+	var zero T
+
+	v, ok := s.Get(key)
+	if !ok {
+		return zero, false, nil
+	}
+
+	t, ok := v.(T)
+	if !ok {
+		return zero, true, valueTypeError(key, v, zero)
+	}
+	return t, true, nil
+}
+
+// GetString returns the string value of the key.
+func (s *session) GetString(key interface{}) (string, bool, error) {
+	return Get[string](s, key)
+}
+
+// GetInt returns the integer value of the key.
+// Numbers decoded by JSONSerializer are converted as long as they are integral.
+func (s *session) GetInt(key interface{}) (int, bool, error) {
+	v, ok := s.Get(key)
+	if !ok {
+		return 0, false, nil
+	}
+
+	switch n := v.(type) {
+	case int:
+		return n, true, nil
+	case int32:
+		return int(n), true, nil
+	case int64:
+		return int(n), true, nil
+	case float64:
+		if n == math.Trunc(n) {
+			return int(n), true, nil
+		}
+	case json.Number:
+		if i, err := n.Int64(); err == nil {
+			return int(i), true, nil
+		}
+	}
+	return 0, true, valueTypeError(key, v, 0)
+}
+
+// GetTime returns the time value of the key.
+// RFC 3339 strings, which are how JSONSerializer encodes times, are parsed.
+func (s *session) GetTime(key interface{}) (time.Time, bool, error) {
+	v, ok := s.Get(key)
+	if !ok {
+		return time.Time{}, false, nil
+	}
+
+	switch t := v.(type) {
+	case time.Time:
+		return t, true, nil
+	case string:
+		if parsed, err := time.Parse(time.RFC3339Nano, t); err == nil {
+			return parsed, true, nil
+		}
+	}
+	return time.Time{}, true, valueTypeError(key, v, time.Time{})
+}
+
+func valueTypeError(key, value, expected interface{}) error {
+	return fmt.Errorf("%w: %v is %T, not %T", ErrValueType, key, value, expected)
+}
@@ -0,0 +1,46 @@
+package session
+
+import (
+	"log"
+
+	"github.com/ridewindx/mel"
+)
+
+// autoSaveWriter saves the session before the response header is written,
+// since the session cookie can't be set afterwards.
+type autoSaveWriter struct {
+	mel.ResponseWriter
+	session *session
+	saved   bool
+}
+
+func (w *autoSaveWriter) save() {
+	if w.saved || w.ResponseWriter.Written() {
+		return
+	}
+	w.saved = true
+
+	if err := w.session.Save(); err != nil {
+		log.Printf("session: %s\n", err)
+	}
+}
+
+func (w *autoSaveWriter) WriteHeaderNow() {
+	w.save()
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+func (w *autoSaveWriter) Write(data []byte) (int, error) {
+	w.save()
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *autoSaveWriter) WriteString(s string) (int, error) {
+	w.save()
+	return w.ResponseWriter.WriteString(s)
+}
+
+func (w *autoSaveWriter) Flush() {
+	w.save()
+	w.ResponseWriter.Flush()
+}